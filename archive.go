@@ -0,0 +1,179 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"text/template"
+	"time"
+)
+
+// Returns the years which contain posts, most recent first.
+func (s *Site) Years() (years []int) {
+	var seen = map[int]bool{}
+	years = []int{}
+	for _, post := range s.PostsByDate() {
+		year := post.SureDate().Year()
+		if !seen[year] {
+			seen[year] = true
+			years = append(years, year)
+		}
+	}
+	return
+}
+
+// Returns the months of the given year which contain posts, most recent first.
+func (s *Site) Months(year int) (months []int) {
+	var seen = map[int]bool{}
+	months = []int{}
+	for _, post := range s.PostsIn(year, 0) {
+		month := int(post.SureDate().Month())
+		if !seen[month] {
+			seen[month] = true
+			months = append(months, month)
+		}
+	}
+	return
+}
+
+// Returns the posts published in the given year and month, most recent first.
+// A month of zero returns all of the posts published in the year.
+func (s *Site) PostsIn(year int, month int) (posts Posts) {
+	posts = Posts{}
+	for _, post := range s.PostsByDate() {
+		date := post.SureDate()
+		if date.Year() != year {
+			continue
+		}
+		if month != 0 && int(date.Month()) != month {
+			continue
+		}
+		posts = append(posts, post)
+	}
+	return
+}
+
+// Returns template data describing an archive period.
+// A month of zero describes the entire year.
+func (s *Site) archiveData(year int, month int) map[string]interface{} {
+	var data = map[string]interface{}{
+		"Year":      year,
+		"Month":     "",
+		"MonthName": "",
+		"Date":      time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if month != 0 {
+		data["Month"] = fmt.Sprintf("%02d", month)
+		data["MonthName"] = time.Month(month).String()
+		data["Date"] = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return data
+}
+
+// Parses the formats of archive paths, so that mistakes in the site config
+// are reported before rendering.
+func (s *Site) parseArchiveFormats() (err error) {
+	var year, month string
+	if year = s.meta.YearFormat; year == "" {
+		year = "/{{.Year}}/"
+	}
+	if month = s.meta.MonthFormat; month == "" {
+		month = "/{{.Year}}/{{.Month}}/"
+	}
+	if s.yearTemplate, err = template.New("year").Parse(year); err != nil {
+		return fmt.Errorf("Could not parse year format: %v", err)
+	}
+	if s.monthTemplate, err = template.New("month").Parse(month); err != nil {
+		return fmt.Errorf("Could not parse month format: %v", err)
+	}
+	if _, err = s.ArchivePath(1970, 1); err != nil {
+		return
+	}
+	_, err = s.ArchivePath(1970, 0)
+	return
+}
+
+// Returns the archive path for the given year and month.
+// A month of zero returns the path of the archive for the entire year.
+func (s *Site) ArchivePath(year int, month int) (out string, err error) {
+	var (
+		b = bytes.NewBufferString("")
+		t = s.yearTemplate
+	)
+	if month != 0 {
+		t = s.monthTemplate
+	}
+	if err = t.Execute(b, s.archiveData(year, month)); err != nil {
+		return "", fmt.Errorf("Could not get archive path for %v/%v: %v", year, month, err)
+	}
+	return b.String(), nil
+}
+
+// Renders a single archive page for the given year and month.
+func (gw *GhostWriter) renderArchive(year int, month int) (err error) {
+	var (
+		archivepath string
+		dst         string
+		data        = gw.site.archiveData(year, month)
+		key         = fmt.Sprintf("archive:%v/%v", year, month)
+		hash        = digestListing(gw.contentDigest, key)
+		files       []string
+	)
+	if archivepath, err = gw.site.ArchivePath(year, month); err != nil {
+		return gw.buildError(filepath.Join(gw.args.src, gw.args.config), err)
+	}
+	dst = path.Join(gw.args.dst, archivepath, "index.html")
+	gw.pages = append(gw.pages, archivepath)
+	if entry := gw.cached(key, hash); entry != nil {
+		gw.cachedPages(entry)
+		return
+	}
+	data["Posts"] = gw.site.PostsIn(year, month)
+	data["Site"] = gw.site
+	gw.log.Printf("Rendering archive %v\n", dst)
+	files, err = gw.renderPaged(archivepath, dst, data, func(d map[string]interface{}) (string, error) {
+		return gw.rootTemplate.RenderText(gw.archiveTemplate, d)
+	})
+	if err != nil {
+		return gw.buildError(gw.templatePath(gw.args.archiveTemplate), err)
+	}
+	gw.record(key, hash, files)
+	return
+}
+
+// Renders an archive page for every year and month containing posts.
+func (gw *GhostWriter) renderArchives() (err error) {
+	var years []int
+	if gw.archiveTemplate == "" {
+		return
+	}
+	years = gw.site.Years()
+	sort.Ints(years)
+	for _, year := range years {
+		if err = gw.renderArchive(year, 0); err != nil {
+			return
+		}
+		for _, month := range gw.site.Months(year) {
+			if err = gw.renderArchive(year, month); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
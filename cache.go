@@ -0,0 +1,149 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/kurrik/fauxfile"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Content types which are worth compressing, by prefix.
+var COMPRESSIBLE_TYPES = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"application/atom+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+// Returns true if responses of the given content type should be gzipped.
+func isCompressible(ctype string) bool {
+	for _, prefix := range COMPRESSIBLE_TYPES {
+		if strings.HasPrefix(ctype, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the request accepts a gzip encoded response.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(enc, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Returns a strong ETag for content read from r.
+func contentETag(r io.Reader) (etag string, err error) {
+	var h = sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return
+	}
+	etag = fmt.Sprintf("\"%v\"", hex.EncodeToString(h.Sum(nil))[:32])
+	return
+}
+
+// Returns a gzip compressed copy of data.
+func gzipBytes(data []byte) ([]byte, error) {
+	var (
+		b bytes.Buffer
+		z = gzip.NewWriter(&b)
+	)
+	if _, err := z.Write(data); err != nil {
+		return nil, err
+	}
+	if err := z.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Returns the Cache-Control value of the first configured rule matching the
+// request path p.  Patterns without a slash are matched against the file name.
+func (h *Handler) cacheControl(p string) string {
+	for _, rule := range h.config.Cache {
+		target := p
+		if !strings.Contains(rule.Path, "/") {
+			target = path.Base(p)
+		}
+		if ok, _ := path.Match(rule.Path, target); ok {
+			return rule.Control
+		}
+	}
+	return ""
+}
+
+// A previously computed ETag, valid while the file is unchanged.
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// Returns the ETag of the file at p, computing it only if the file has
+// changed since it was last served.
+func (h *Handler) fileETag(p string, info os.FileInfo) (etag string, err error) {
+	var (
+		entry etagEntry
+		f     fauxfile.File
+		ok    bool
+	)
+	h.etagMu.Lock()
+	entry, ok = h.etags[p]
+	h.etagMu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+	if f, err = h.gw.fs.Open(p); err != nil {
+		return
+	}
+	defer f.Close()
+	if etag, err = contentETag(f); err != nil {
+		return
+	}
+	h.etagMu.Lock()
+	defer h.etagMu.Unlock()
+	if h.etags == nil {
+		h.etags = map[string]etagEntry{}
+	}
+	h.etags[p] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	return
+}
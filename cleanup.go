@@ -0,0 +1,138 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Paths in dst which are never removed, in addition to the site keep-list.
+var DEFAULT_KEEP = []string{".git"}
+
+// Returns the slash separated path of p relative to the destination dir, or
+// false if p is outside of it.
+func (gw *GhostWriter) outputPath(p string) (rel string, ok bool) {
+	var err error
+	if rel, err = filepath.Rel(gw.args.dst, p); err != nil {
+		return "", false
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", false
+	}
+	return rel, true
+}
+
+// Records that the file at p was produced by the current build.
+func (gw *GhostWriter) track(p string) {
+	var (
+		rel string
+		ok  bool
+	)
+	if rel, ok = gw.outputPath(p); !ok {
+		return
+	}
+	gw.writtenMu.Lock()
+	defer gw.writtenMu.Unlock()
+	gw.written[rel] = true
+}
+
+// Returns true if the path, relative to dst, matches the keep-list.
+// Patterns use path.Match syntax and keep everything beneath a matching dir.
+func (gw *GhostWriter) isKept(rel string) bool {
+	var patterns = append(append([]string{}, DEFAULT_KEEP...), gw.site.meta.Keep...)
+	for _, pattern := range patterns {
+		pattern = strings.Trim(pattern, "/")
+		for p := rel; p != "." && p != ""; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Collects files beneath the dir at p, relative to dst, which were not
+// produced by the current build.
+func (gw *GhostWriter) staleFiles(p string) (stale []string, err error) {
+	var (
+		names []string
+		rel   string
+		child []string
+	)
+	if names, err = gw.readDir(p); err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		src := filepath.Join(p, n)
+		rel, _ = gw.outputPath(src)
+		if gw.isKept(rel) {
+			continue
+		}
+		if gw.isDir(src) {
+			if child, err = gw.staleFiles(src); err != nil {
+				return
+			}
+			stale = append(stale, child...)
+		} else if !gw.written[rel] {
+			stale = append(stale, rel)
+		}
+	}
+	return
+}
+
+// Removes files from dst which were not produced by the current build, along
+// with any directories left empty by their removal.  With args.dryRun the
+// files are only listed.  Returns the paths, relative to dst, of stale files.
+func (gw *GhostWriter) removeStale() (stale []string, err error) {
+	var (
+		dirs  = map[string]bool{}
+		names []string
+		p     string
+	)
+	if stale, err = gw.staleFiles(gw.args.dst); err != nil {
+		return
+	}
+	for _, rel := range stale {
+		if gw.args.dryRun {
+			gw.log.Printf("Would remove stale file %v\n", rel)
+			continue
+		}
+		gw.log.Printf("Removing stale file %v\n", rel)
+		if err = gw.fs.Remove(filepath.Join(gw.args.dst, rel)); err != nil {
+			return
+		}
+		for d := path.Dir(rel); d != "." && d != "/"; d = path.Dir(d) {
+			dirs[d] = true
+		}
+	}
+	// Remove the deepest directories first.
+	for d := range dirs {
+		names = append(names, d)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, d := range names {
+		p = filepath.Join(gw.args.dst, d)
+		if children, derr := gw.readDir(p); derr == nil && len(children) == 0 {
+			gw.log.Printf("Removing empty dir %v\n", d)
+			gw.fs.Remove(p)
+		}
+	}
+	return
+}
@@ -47,6 +47,7 @@ func writeFile(gw *GhostWriter, content string, dst string) (err error) {
 	if fdst, err = gw.fs.Create(dst); err != nil {
 		return
 	}
+	gw.track(dst)
 	defer fdst.Close()
 	_, err = fdst.WriteString(content)
 	return
@@ -72,11 +73,18 @@ func printPosts(gw *GhostWriter) (err error) {
 	}
 	sort.Strings(names)
 	for _, id = range names {
-		if !gw.isDir(filepath.Join(src, id)) {
+		msrc = filepath.Join(src, id)
+		switch {
+		case gw.isDir(msrc):
+			post := NewPost(id, msrc, gw.site)
+			_, err = gw.parsePostMeta(gw.postBodySrc(post), filepath.Join(msrc, "meta.yaml"))
+		case gw.isBodyFile(id) && gw.hasFrontMatter(msrc):
+			_, err = gw.parsePostMeta(msrc, "")
+			id = strings.TrimSuffix(id, filepath.Ext(id))
+		default:
 			continue
 		}
-		msrc = filepath.Join(name, id, "meta.yaml")
-		if _, err = gw.parsePostMeta(msrc); err != nil {
+		if err != nil {
 			// Not a post, but don't raise an error.
 			continue
 		}
@@ -0,0 +1,486 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+// Ways of removing EXIF metadata from copied JPEG files.
+const (
+	// Removes location data from EXIF.  XMP metadata, which may repeat the
+	// location, is removed entirely.
+	STRIP_EXIF_GPS = "gps"
+	// Removes all EXIF and XMP metadata, keeping only the orientation.
+	STRIP_EXIF_ALL = "all"
+)
+
+// EXIF tags read by ghostwriter.
+const (
+	exifTagMake           = 0x010f
+	exifTagModel          = 0x0110
+	exifTagOrientation    = 0x0112
+	exifTagDateTime       = 0x0132
+	exifTagExposureTime   = 0x829a
+	exifTagFNumber        = 0x829d
+	exifTagExifIFD        = 0x8769
+	exifTagGPSIFD         = 0x8825
+	exifTagISO            = 0x8827
+	exifTagDateTimeOrig   = 0x9003
+	exifTagOffsetTimeOrig = 0x9011
+	exifTagFocalLength    = 0x920a
+	gpsTagLatitudeRef     = 0x0001
+	gpsTagLatitude        = 0x0002
+	gpsTagLongitudeRef    = 0x0003
+	gpsTagLongitude       = 0x0004
+	gpsTagAltitudeRef     = 0x0005
+	gpsTagAltitude        = 0x0006
+)
+
+// Prefixes of the APP1 segments which hold EXIF and XMP metadata.  XMP which
+// does not fit in one segment continues in extended XMP segments.
+var (
+	exifHeader        = []byte("Exif\x00\x00")
+	xmpHeader         = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtendedHeader = []byte("http://ns.adobe.com/xmp/extension/\x00")
+)
+
+// Camera details read from the EXIF metadata of a photo.  Fields are zero
+// if the photo does not record them.
+type Exif struct {
+	Orientation int
+	Taken       time.Time
+	Make        string
+	Model       string
+	Exposure    string
+	FNumber     float64
+	ISO         int
+	FocalLength float64
+	GPS         *GPS
+}
+
+// The location a photo was taken, in decimal degrees and meters above sea
+// level.
+type GPS struct {
+	Latitude  float64
+	Longitude float64
+	Altitude  float64
+}
+
+// Returns true if the orientation swaps the width and height of the image.
+func (e *Exif) Transposed() bool {
+	return e != nil && e.Orientation >= 5 && e.Orientation <= 8
+}
+
+// A single field of a TIFF image file directory.
+type tiffEntry struct {
+	typ    uint16
+	count  uint32
+	offset int // Position of the value within the TIFF data.
+}
+
+// Sizes of the TIFF field types, by type number.
+var tiffTypeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+// Returns the size in bytes of the entry's value.
+func (e tiffEntry) size() int {
+	return tiffTypeSizes[e.typ] * int(e.count)
+}
+
+// TIFF formatted EXIF data.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// Validates the TIFF header of data and returns the offset of IFD0.
+func newTIFF(data []byte) (t *tiff, ifd0 int, err error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("EXIF data is truncated")
+	}
+	t = &tiff{data: data}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("EXIF data has invalid byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return nil, 0, fmt.Errorf("EXIF data has invalid TIFF header")
+	}
+	ifd0 = int(t.order.Uint32(data[4:]))
+	return
+}
+
+// Reads the entries of the image file directory at offset.
+func (t *tiff) ifd(offset int) (entries map[uint16]tiffEntry, err error) {
+	if offset <= 0 || offset+2 > len(t.data) {
+		return nil, fmt.Errorf("EXIF directory offset %v out of range", offset)
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if offset+2+count*12 > len(t.data) {
+		return nil, fmt.Errorf("EXIF directory at %v is truncated", offset)
+	}
+	entries = map[uint16]tiffEntry{}
+	for i := 0; i < count; i++ {
+		p := offset + 2 + i*12
+		e := tiffEntry{
+			typ:    t.order.Uint16(t.data[p+2:]),
+			count:  t.order.Uint32(t.data[p+4:]),
+			offset: p + 8,
+		}
+		if e.size() > 4 {
+			e.offset = int(t.order.Uint32(t.data[p+8:]))
+		}
+		if e.size() == 0 || e.offset < 0 || e.offset+e.size() > len(t.data) {
+			continue
+		}
+		entries[t.order.Uint16(t.data[p:])] = e
+	}
+	return
+}
+
+// Returns the value of an ASCII entry.
+func (t *tiff) ascii(e tiffEntry) string {
+	var s = string(t.data[e.offset : e.offset+e.size()])
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+// Returns the nth value of an integer entry.
+func (t *tiff) uint(e tiffEntry, n int) uint32 {
+	if n >= int(e.count) {
+		return 0
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(t.data[e.offset+n])
+	case 3:
+		return uint32(t.order.Uint16(t.data[e.offset+2*n:]))
+	case 4, 9:
+		return t.order.Uint32(t.data[e.offset+4*n:])
+	}
+	return 0
+}
+
+// Returns the nth value of a rational entry as its numerator and
+// denominator.
+func (t *tiff) rational(e tiffEntry, n int) (num int64, den int64) {
+	if n >= int(e.count) || (e.typ != 5 && e.typ != 10) {
+		return 0, 0
+	}
+	p := t.data[e.offset+8*n:]
+	if e.typ == 10 {
+		return int64(int32(t.order.Uint32(p))), int64(int32(t.order.Uint32(p[4:])))
+	}
+	return int64(t.order.Uint32(p)), int64(t.order.Uint32(p[4:]))
+}
+
+// Returns the nth value of a rational entry as a float.
+func (t *tiff) float(e tiffEntry, n int) float64 {
+	num, den := t.rational(e, n)
+	if den == 0 {
+		return 0
+	}
+	return float64(num) / float64(den)
+}
+
+// Formats an exposure time in seconds the way cameras do, such as "1/125".
+func formatExposure(num int64, den int64) string {
+	if num <= 0 || den <= 0 {
+		return ""
+	}
+	if num >= den {
+		return fmt.Sprintf("%g", math.Round(float64(num)/float64(den)*10)/10)
+	}
+	return fmt.Sprintf("1/%v", int64(math.Round(float64(den)/float64(num))))
+}
+
+// Converts a degrees, minutes, seconds entry to decimal degrees, negated
+// for references south or west.
+func (t *tiff) degrees(e tiffEntry, ref string) float64 {
+	var d = t.float(e, 0) + t.float(e, 1)/60 + t.float(e, 2)/3600
+	if ref == "S" || ref == "W" {
+		d = -d
+	}
+	return d
+}
+
+// Parses TIFF formatted EXIF data.
+func parseExif(data []byte) (out *Exif, err error) {
+	var (
+		t       *tiff
+		offset  int
+		ifd0    map[uint16]tiffEntry
+		sub     map[uint16]tiffEntry
+		e       tiffEntry
+		ok      bool
+		taken   string
+		zone    string
+		subErr  error
+		gpsData map[uint16]tiffEntry
+	)
+	if t, offset, err = newTIFF(data); err != nil {
+		return
+	}
+	if ifd0, err = t.ifd(offset); err != nil {
+		return
+	}
+	out = &Exif{}
+	if e, ok = ifd0[exifTagOrientation]; ok {
+		out.Orientation = int(t.uint(e, 0))
+	}
+	if e, ok = ifd0[exifTagMake]; ok {
+		out.Make = t.ascii(e)
+	}
+	if e, ok = ifd0[exifTagModel]; ok {
+		out.Model = t.ascii(e)
+	}
+	if e, ok = ifd0[exifTagDateTime]; ok {
+		taken = t.ascii(e)
+	}
+	if e, ok = ifd0[exifTagExifIFD]; ok {
+		if sub, subErr = t.ifd(int(t.uint(e, 0))); subErr == nil {
+			if e, ok = sub[exifTagDateTimeOrig]; ok {
+				taken = t.ascii(e)
+			}
+			if e, ok = sub[exifTagOffsetTimeOrig]; ok {
+				zone = t.ascii(e)
+			}
+			if e, ok = sub[exifTagExposureTime]; ok {
+				out.Exposure = formatExposure(t.rational(e, 0))
+			}
+			if e, ok = sub[exifTagFNumber]; ok {
+				out.FNumber = t.float(e, 0)
+			}
+			if e, ok = sub[exifTagISO]; ok {
+				out.ISO = int(t.uint(e, 0))
+			}
+			if e, ok = sub[exifTagFocalLength]; ok {
+				out.FocalLength = t.float(e, 0)
+			}
+		}
+	}
+	if taken != "" {
+		if zone != "" {
+			out.Taken, _ = time.Parse("2006:01:02 15:04:05-07:00", taken+zone)
+		} else {
+			out.Taken, _ = time.Parse("2006:01:02 15:04:05", taken)
+		}
+	}
+	if e, ok = ifd0[exifTagGPSIFD]; ok {
+		if gpsData, subErr = t.ifd(int(t.uint(e, 0))); subErr == nil {
+			lat, hasLat := gpsData[gpsTagLatitude]
+			long, hasLong := gpsData[gpsTagLongitude]
+			if hasLat && hasLong {
+				out.GPS = &GPS{
+					Latitude:  t.degrees(lat, t.ascii(gpsData[gpsTagLatitudeRef])),
+					Longitude: t.degrees(long, t.ascii(gpsData[gpsTagLongitudeRef])),
+				}
+				if e, ok = gpsData[gpsTagAltitude]; ok {
+					out.GPS.Altitude = t.float(e, 0)
+					if ref, ok := gpsData[gpsTagAltitudeRef]; ok && t.uint(ref, 0) == 1 {
+						out.GPS.Altitude = -out.GPS.Altitude
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// Calls fn with the marker and payload of each JPEG segment preceding the
+// image data, which is returned unread in rest.  Returns an error if r does
+// not hold a JPEG.
+func readJPEGSegments(r io.Reader, fn func(marker byte, payload []byte) error) (rest io.Reader, err error) {
+	var (
+		br     = bufio.NewReader(r)
+		header [4]byte
+		marker byte
+	)
+	if _, err = io.ReadFull(br, header[:2]); err != nil {
+		return
+	}
+	if header[0] != 0xff || header[1] != 0xd8 {
+		return nil, fmt.Errorf("Not a JPEG file")
+	}
+	for {
+		if _, err = io.ReadFull(br, header[:2]); err != nil {
+			return
+		}
+		if header[0] != 0xff {
+			return nil, fmt.Errorf("Invalid JPEG marker")
+		}
+		for marker = header[1]; marker == 0xff; {
+			if marker, err = br.ReadByte(); err != nil {
+				return
+			}
+		}
+		if marker == 0xda || marker == 0xd9 {
+			rest = io.MultiReader(bytes.NewReader([]byte{0xff, marker}), br)
+			return
+		}
+		if marker >= 0xd0 && marker <= 0xd7 || marker == 0x01 {
+			continue
+		}
+		if _, err = io.ReadFull(br, header[2:4]); err != nil {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 2 {
+			return nil, fmt.Errorf("Invalid JPEG segment length")
+		}
+		payload := make([]byte, length-2)
+		if _, err = io.ReadFull(br, payload); err != nil {
+			return
+		}
+		if err = fn(marker, payload); err != nil {
+			return
+		}
+	}
+}
+
+// Reads EXIF metadata from a JPEG.  Returns nil if r does not hold a JPEG
+// or the JPEG has no readable EXIF metadata.
+func readExif(r io.Reader) (out *Exif) {
+	readJPEGSegments(r, func(marker byte, payload []byte) error {
+		if marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) {
+			out, _ = parseExif(payload[len(exifHeader):])
+			return io.EOF // Stop reading.
+		}
+		return nil
+	})
+	return
+}
+
+// Removes the GPS directory from TIFF formatted EXIF data in place, zeroing
+// both its entries and the values they point to.
+func scrubGPS(data []byte) (err error) {
+	var (
+		t      *tiff
+		offset int
+		ifd0   map[uint16]tiffEntry
+		ptr    tiffEntry
+		ok     bool
+	)
+	if t, offset, err = newTIFF(data); err != nil {
+		return
+	}
+	if ifd0, err = t.ifd(offset); err != nil {
+		return
+	}
+	if ptr, ok = ifd0[exifTagGPSIFD]; !ok {
+		return
+	}
+	// Pointers into the TIFF header are malformed, and scrubbing them would
+	// destroy the header.
+	offset = int(t.uint(ptr, 0))
+	if offset < 8 || offset+2 > len(data) {
+		return
+	}
+	count := int(t.order.Uint16(data[offset:]))
+	for i := 0; i < count; i++ {
+		p := offset + 2 + i*12
+		if p+12 > len(data) {
+			break
+		}
+		e := tiffEntry{typ: t.order.Uint16(data[p+2:]), count: t.order.Uint32(data[p+4:])}
+		if size := e.size(); size > 4 {
+			if v := int(t.order.Uint32(data[p+8:])); v >= 8 && v+size <= len(data) {
+				zero(data[v : v+size])
+			}
+		}
+		zero(data[p : p+12])
+	}
+	// An empty directory, whose next directory pointer is one of the
+	// zeroed entries.
+	t.order.PutUint16(data[offset:], 0)
+	return
+}
+
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Returns an EXIF segment payload recording only the given orientation.
+func orientationExif(orientation int) []byte {
+	var b bytes.Buffer
+	b.Write(exifHeader)
+	b.WriteString("MM\x00\x2a\x00\x00\x00\x08")
+	binary.Write(&b, binary.BigEndian, uint16(1))
+	binary.Write(&b, binary.BigEndian, uint16(exifTagOrientation))
+	binary.Write(&b, binary.BigEndian, uint16(3))
+	binary.Write(&b, binary.BigEndian, uint32(1))
+	binary.Write(&b, binary.BigEndian, uint16(orientation))
+	binary.Write(&b, binary.BigEndian, uint16(0))
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	return b.Bytes()
+}
+
+// Returns a copy of the JPEG in data with metadata removed according to
+// mode, one of STRIP_EXIF_GPS or STRIP_EXIF_ALL.
+func stripExif(data []byte, mode string) (out []byte, err error) {
+	var (
+		b    bytes.Buffer
+		rest io.Reader
+	)
+	if mode != STRIP_EXIF_GPS && mode != STRIP_EXIF_ALL {
+		return nil, fmt.Errorf("Unknown EXIF strip mode %q", mode)
+	}
+	b.Write([]byte{0xff, 0xd8})
+	rest, err = readJPEGSegments(bytes.NewReader(data), func(marker byte, payload []byte) error {
+		if marker == 0xe1 && bytes.HasPrefix(payload, exifHeader) {
+			switch mode {
+			case STRIP_EXIF_GPS:
+				if err := scrubGPS(payload[len(exifHeader):]); err != nil {
+					return err
+				}
+			case STRIP_EXIF_ALL:
+				exif, _ := parseExif(payload[len(exifHeader):])
+				if exif == nil || exif.Orientation <= 1 {
+					return nil
+				}
+				payload = orientationExif(exif.Orientation)
+			}
+		}
+		if marker == 0xe1 && (bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtendedHeader)) {
+			// XMP may hold a location in both modes.
+			return nil
+		}
+		b.Write([]byte{0xff, marker})
+		binary.Write(&b, binary.BigEndian, uint16(len(payload)+2))
+		b.Write(payload)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(&b, rest); err != nil {
+		return
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,252 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// Serializable Atom 1.0 document, see RFC 4287.
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string       `xml:"title"`
+	Id      string       `xml:"id"`
+	Links   []atomLink   `xml:"link"`
+	Updated string       `xml:"updated"`
+	Author  *atomPerson  `xml:"author,omitempty"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Title     string       `xml:"title"`
+	Id        string       `xml:"id"`
+	Links     []atomLink   `xml:"link"`
+	Published string       `xml:"published"`
+	Updated   string       `xml:"updated"`
+	Content   *atomContent `xml:"content"`
+}
+
+// Serializable RSS 2.0 document.
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title          string     `xml:"title"`
+	Link           string     `xml:"link"`
+	Description    string     `xml:"description"`
+	ManagingEditor string     `xml:"managingEditor,omitempty"`
+	LastBuildDate  string     `xml:"lastBuildDate"`
+	Items          []*rssItem `xml:"item"`
+}
+
+type rssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Guid        rssGuid `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Author      string  `xml:"author,omitempty"`
+	Description string  `xml:"description"`
+}
+
+// Returns the posts which should be included in a feed, newest first.
+func (gw *GhostWriter) feedPosts(posts Posts) Posts {
+	var count = gw.site.meta.Feed.Count
+	if count <= 0 {
+		count = gw.site.meta.RecentCount
+	}
+	if count <= 0 || count > len(posts) {
+		count = len(posts)
+	}
+	return posts[0:count]
+}
+
+// Returns the HTML content used for a post's feed entry.
+func (gw *GhostWriter) feedContent(post *Post) string {
+	if gw.site.meta.Feed.FullBody || post.Snippet == "" {
+		return post.Body
+	}
+	return post.Snippet
+}
+
+// Returns the most recent update of the supplied posts, or the render time.
+func (gw *GhostWriter) feedUpdated(posts Posts) (t time.Time) {
+	if len(posts) == 0 {
+		return gw.site.Rendered
+	}
+	for _, post := range posts {
+		if post.Updated().After(t) {
+			t = post.Updated()
+		}
+	}
+	return
+}
+
+// Serializes an XML document into the destination directory at path p.
+func (gw *GhostWriter) writeXML(p string, doc interface{}) (err error) {
+	var (
+		dst  = path.Join(gw.args.dst, p)
+		data []byte
+	)
+	if data, err = xml.MarshalIndent(doc, "", "  "); err != nil {
+		return
+	}
+	gw.fs.MkdirAll(path.Dir(dst), 0755)
+	gw.log.Printf("Writing %v\n", dst)
+	return writeFile(gw, xml.Header+string(data)+"\n", dst)
+}
+
+// Renders an Atom feed for the given posts to path p.
+func (gw *GhostWriter) renderAtom(p string, title string, alt string, posts Posts) (err error) {
+	var (
+		root = gw.site.Root()
+		feed *atomFeed
+	)
+	feed = &atomFeed{
+		Title: title,
+		Id:    root + p,
+		Links: []atomLink{
+			atomLink{Rel: "self", Href: root + p},
+			atomLink{Rel: "alternate", Href: root + alt},
+		},
+		Updated: gw.feedUpdated(posts).Format(time.RFC3339),
+		Entries: []*atomEntry{},
+	}
+	if gw.site.Author() != "" {
+		feed.Author = &atomPerson{
+			Name:  gw.site.Author(),
+			Email: gw.site.Email(),
+		}
+	}
+	for _, post := range posts {
+		feed.Entries = append(feed.Entries, &atomEntry{
+			Title:     post.Title(),
+			Id:        post.Permalink(),
+			Links:     []atomLink{atomLink{Rel: "alternate", Href: post.Permalink()}},
+			Published: post.SureDate().Format(time.RFC3339),
+			Updated:   post.Updated().Format(time.RFC3339),
+			Content:   &atomContent{Type: "html", Body: gw.feedContent(post)},
+		})
+	}
+	return gw.writeXML(p, feed)
+}
+
+// Renders an RSS feed for the given posts to path p.
+func (gw *GhostWriter) renderRSS(p string, title string, alt string, posts Posts) (err error) {
+	var (
+		author string
+		feed   *rssFeed
+	)
+	if gw.site.Email() != "" {
+		author = gw.site.Email()
+		if gw.site.Author() != "" {
+			author = fmt.Sprintf("%v (%v)", gw.site.Email(), gw.site.Author())
+		}
+	}
+	feed = &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:          title,
+			Link:           gw.site.Root() + alt,
+			Description:    title,
+			ManagingEditor: author,
+			LastBuildDate:  gw.feedUpdated(posts).Format(time.RFC1123Z),
+			Items:          []*rssItem{},
+		},
+	}
+	for _, post := range posts {
+		feed.Channel.Items = append(feed.Channel.Items, &rssItem{
+			Title:       post.Title(),
+			Link:        post.Permalink(),
+			Guid:        rssGuid{IsPermaLink: true, Value: post.Permalink()},
+			PubDate:     post.SureDate().Format(time.RFC1123Z),
+			Author:      author,
+			Description: gw.feedContent(post),
+		})
+	}
+	return gw.writeXML(p, feed)
+}
+
+// Renders the Atom and RSS feeds for a list of posts, where configured.
+func (gw *GhostWriter) renderFeed(atomPath string, rssPath string, title string, alt string, posts Posts) (err error) {
+	posts = gw.feedPosts(posts)
+	if atomPath != "" {
+		if err = gw.renderAtom(atomPath, title, alt, posts); err != nil {
+			return
+		}
+	}
+	if rssPath != "" {
+		if err = gw.renderRSS(rssPath, title, alt, posts); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Renders the site-wide feeds, as well as a feed for every tag.
+func (gw *GhostWriter) renderFeeds() (err error) {
+	var (
+		tag   string
+		posts Posts
+	)
+	err = gw.renderFeed(
+		gw.site.AtomPath(),
+		gw.site.RSSPath(),
+		gw.site.Title(),
+		"/",
+		gw.site.PostsByDate())
+	if err != nil {
+		return
+	}
+	for tag, posts = range gw.site.Tags {
+		sort.Sort(ByDateDesc{posts})
+		err = gw.renderFeed(
+			gw.site.tagFeedPath(tag, gw.site.AtomPath()),
+			gw.site.tagFeedPath(tag, gw.site.RSSPath()),
+			fmt.Sprintf("%v - %v", gw.site.Title(), tag),
+			gw.site.TagPath(tag),
+			posts)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
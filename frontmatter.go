@@ -0,0 +1,74 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+)
+
+// Line which opens and closes YAML front matter at the start of a post file.
+const FRONT_MATTER_DELIMITER = "---"
+
+// Splits a post file into its YAML front matter and the content following
+// it.  Front matter starts on the first line of the file and ends with a line
+// consisting of "---" or "...".  If the file has none, front is empty and body
+// is the whole file.
+func splitFrontMatter(content string) (front string, body string) {
+	var (
+		text  = strings.TrimPrefix(content, "\ufeff")
+		lines = strings.SplitAfter(text, "\n")
+		size  int
+	)
+	if len(lines) < 2 || strings.TrimRight(lines[0], " \t\r\n") != FRONT_MATTER_DELIMITER {
+		return "", content
+	}
+	size = len(lines[0])
+	for _, line := range lines[1:] {
+		switch strings.TrimRight(line, " \t\r\n") {
+		case FRONT_MATTER_DELIMITER, "...":
+			front = text[len(lines[0]):size]
+			body = text[size+len(line):]
+			if front == "" {
+				// Allows an empty block to mark a file as a post.
+				front = "{}"
+			}
+			return
+		}
+		size += len(line)
+	}
+	return "", content
+}
+
+// Returns the content of a post file without its front matter.  The front
+// matter is replaced with blank lines so that template errors in the body
+// report the right line.
+func stripFrontMatter(content string) string {
+	var front, body = splitFrontMatter(content)
+	if front == "" {
+		return content
+	}
+	return strings.Repeat("\n", strings.Count(content[:len(content)-len(body)], "\n")) + body
+}
+
+// Returns true if the file at p starts with front matter.  Other Markdown
+// files in the posts directory are not posts.
+func (gw *GhostWriter) hasFrontMatter(p string) bool {
+	var content, err = gw.readFile(p)
+	if err != nil {
+		return false
+	}
+	front, _ := splitFrontMatter(content)
+	return front != ""
+}
@@ -17,13 +17,14 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/kurrik/fauxfile"
 	"github.com/kurrik/tmpl"
-	"gopkg.in/russross/blackfriday.v2"
 	"gopkg.in/yaml.v2"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
@@ -32,23 +33,40 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
 
 // Master Control Program.
 type GhostWriter struct {
-	args         *Args
-	fs           fauxfile.Filesystem
-	log          *log.Logger
-	site         *Site
-	links        map[string]string
-	rootTemplate *tmpl.Templates
-	postTemplate string
-	tagsTemplate string
+	args            *Args
+	fs              fauxfile.Filesystem
+	log             *log.Logger
+	site            *Site
+	links           map[string]string // Read-only once posts are parsed.
+	pages           []string
+	written         map[string]bool // Files produced by the current build.
+	writtenMu       sync.Mutex
+	stale           []string
+	reloader        *Reloader // Notifies browsers of rebuilds, if watching.
+	status          BuildStatus
+	statusMu        sync.Mutex
+	scheduled       time.Time
+	manifest        *Manifest
+	prevManifest    *Manifest
+	images          *ImageCache
+	siteDigest      string
+	bodyDigest      string
+	contentDigest   string
+	rootTemplate    *tmpl.Templates
+	postTemplate    string
+	tagsTemplate    string
+	archiveTemplate string
 }
 
-// Creates a new GhostWriter.
+// Creates a new GhostWriter.  Posts are rendered in parallel, so fs must be
+// safe for concurrent use.
 func NewGhostWriter(fs fauxfile.Filesystem, args *Args) *GhostWriter {
 	gw := &GhostWriter{
 		args:  args,
@@ -66,6 +84,7 @@ func NewGhostWriter(fs fauxfile.Filesystem, args *Args) *GhostWriter {
 
 // Parses the src directory, rendering into dst as needed.
 func (gw *GhostWriter) Process() (err error) {
+	defer func() { gw.setStatus(err) }()
 	if gw.args.before != "" {
 		var (
 			cmd *exec.Cmd
@@ -80,6 +99,11 @@ func (gw *GhostWriter) Process() (err error) {
 		gw.log.Printf("Output:\n%v\n", out.String())
 	}
 	gw.links = make(map[string]string)
+	gw.pages = []string{}
+	gw.written = map[string]bool{}
+	gw.stale = nil
+	gw.scheduled = time.Time{}
+	gw.manifest = NewManifest()
 	gw.site = &Site{
 		Posts:    make(map[string]*Post),
 		Tags:     make(map[string]Posts),
@@ -88,6 +112,8 @@ func (gw *GhostWriter) Process() (err error) {
 	if err = gw.fs.MkdirAll(gw.args.dst, 0755); err != nil {
 		return
 	}
+	gw.prevManifest = gw.loadManifest()
+	gw.images = gw.loadImageCache()
 	if err = gw.parseSiteMeta(); err != nil {
 		return
 	}
@@ -97,18 +123,46 @@ func (gw *GhostWriter) Process() (err error) {
 	if err = gw.parsePosts(); err != nil {
 		return
 	}
+	if err = gw.digestSite(); err != nil {
+		return
+	}
 	if err = gw.renderPosts(); err != nil {
 		return
 	}
+	gw.contentDigest = gw.digestContent()
 	if err = gw.renderTags(); err != nil {
 		return
 	}
+	if err = gw.renderArchives(); err != nil {
+		return
+	}
+	if err = gw.renderFeeds(); err != nil {
+		return
+	}
 	if err = gw.renderMisc(); err != nil {
 		return
 	}
+	if err = gw.renderSitemap(); err != nil {
+		return
+	}
+	if err = gw.saveManifest(); err != nil {
+		return
+	}
+	if err = gw.saveImageCache(); err != nil {
+		return
+	}
+	if gw.stale, err = gw.removeStale(); err != nil {
+		return
+	}
 	return
 }
 
+// Returns the publish time of the earliest post which was skipped by the last
+// call to Process because it is dated in the future, or a zero time if none.
+func (gw *GhostWriter) NextScheduled() time.Time {
+	return gw.scheduled
+}
+
 // Copies the file at path src to path dst.
 // Returns the number of bytes written or an error if it occurred.
 func (gw *GhostWriter) copyFile(src string, dst string) (n int64, err error) {
@@ -130,6 +184,7 @@ func (gw *GhostWriter) copyFile(src string, dst string) (n int64, err error) {
 	if fdst, err = gw.fs.Create(dst); err != nil {
 		return
 	}
+	gw.track(dst)
 
 	defer func() {
 		if err := fdst.Close(); err != nil {
@@ -141,10 +196,36 @@ func (gw *GhostWriter) copyFile(src string, dst string) (n int64, err error) {
 		return
 	}
 	fdst.Chmod(fi.Mode())
+	if mode := gw.site.meta.Exif.Strip; mode != "" && isJPEG(src) {
+		var data []byte
+		if data, err = ioutil.ReadAll(fsrc); err != nil {
+			return
+		}
+		if data, err = stripExif(data, mode); err != nil {
+			err = fmt.Errorf("Could not strip EXIF from %v: %v", src, err)
+			return
+		}
+		_, err = fdst.Write(data)
+		return
+	}
 	_, err = io.Copy(fdst, fsrc)
 	return
 }
 
+// Returns true if the file at p is named like a JPEG.
+func isJPEG(p string) bool {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".jpg", ".jpeg":
+		return true
+	}
+	return false
+}
+
+// Returns the source path of the named file in the templates dir.
+func (gw *GhostWriter) templatePath(name string) string {
+	return filepath.Join(gw.args.src, gw.args.templates, name)
+}
+
 // Returns true if the specified path is a directory.
 func (gw *GhostWriter) isDir(path string) bool {
 	var (
@@ -157,13 +238,43 @@ func (gw *GhostWriter) isDir(path string) bool {
 	return info.IsDir()
 }
 
-// Parses a post meta file at the given path.
+// Parses post metadata from the front matter of the post file at bodySrc and
+// the meta file at metaSrc, if given, whose values take precedence.
 // Returns a pointer to a populated PostMeta object or an error if it failed.
-func (gw *GhostWriter) parsePostMeta(path string) (meta *PostMeta, err error) {
-	src := filepath.Join(gw.args.src, path)
-	gw.log.Printf("Parsing post meta %v\n", src)
+func (gw *GhostWriter) parsePostMeta(bodySrc string, metaSrc string) (meta *PostMeta, err error) {
+	var (
+		content string
+		front   string
+		found   bool
+	)
 	meta = &PostMeta{}
-	if err = gw.unyaml(src, meta); err != nil {
+	if content, err = gw.readFile(bodySrc); err == nil {
+		if front, _ = splitFrontMatter(content); front != "" {
+			gw.log.Printf("Parsing post front matter %v\n", bodySrc)
+			if err = yaml.Unmarshal([]byte(front), meta); err != nil {
+				return nil, gw.buildError(bodySrc, err)
+			}
+			found = true
+		}
+	}
+	err = nil
+	if metaSrc != "" {
+		// Values in meta.yaml override those in front matter.
+		if _, err = gw.fs.Stat(metaSrc); err == nil {
+			gw.log.Printf("Parsing post meta %v\n", metaSrc)
+			if err = gw.unyaml(metaSrc, meta); err != nil {
+				return
+			}
+			found = true
+		} else if found {
+			err = nil
+		}
+	}
+	if err != nil {
+		return
+	}
+	if !found {
+		err = fmt.Errorf("Post has no meta.yaml or front matter")
 		return
 	}
 	if meta.Date == "" {
@@ -198,23 +309,48 @@ func (gw *GhostWriter) parsePosts() (err error) {
 		// Fail silently
 		return nil
 	}
-	for _, id = range names {
-		if !gw.isDir(filepath.Join(src, id)) {
+	sort.Strings(names)
+	for _, entry := range names {
+		msrc = filepath.Join(name, entry)
+		switch {
+		case gw.isDir(filepath.Join(src, entry)):
+			id = entry
+			post = NewPost(id, filepath.Join(src, id), gw.site)
+		case gw.isBodyFile(entry) && gw.hasFrontMatter(filepath.Join(src, entry)):
+			id = strings.TrimSuffix(entry, filepath.Ext(entry))
+			post = NewFilePost(id, filepath.Join(src, entry), gw.site)
+		default:
 			continue
 		}
-		msrc = filepath.Join(name, id, "meta.yaml")
-		if post, ok = gw.site.Posts[id]; ok == false {
-			post = NewPost(id, filepath.Join(src, id), gw.site)
+		if _, ok = gw.site.Posts[id]; ok {
+			gw.log.Printf("Skipping %v, post %v already exists\n", msrc, id)
+			continue
 		}
-		gw.log.Printf("Parsing post meta %v\n", msrc)
-		if err = post.ParseMeta(gw, msrc); err != nil {
+		if err = post.ParseMeta(gw); err != nil {
 			// Not a post, but don't raise an error.
 			gw.log.Printf("Invalid post at %v: %v\n", msrc, err)
 			return nil
 		}
+		if post.Draft() {
+			if !gw.args.drafts {
+				gw.log.Printf("Skipping draft post %v\n", msrc)
+				continue
+			}
+			gw.log.Printf("Including draft post %v\n", msrc)
+		}
+		if date, derr := post.Date(); derr == nil && date.After(gw.site.Rendered) {
+			if !gw.args.future {
+				gw.log.Printf("Skipping post %v scheduled for %v\n", msrc, date)
+				if gw.scheduled.IsZero() || date.Before(gw.scheduled) {
+					gw.scheduled = date
+				}
+				continue
+			}
+			gw.log.Printf("Including future post %v\n", msrc)
+		}
 		// Add to site posts after determining whether it's a real post.
 		gw.site.Posts[id] = post
-		if lnames, err = gw.readDir(filepath.Join(src, id)); err != nil {
+		if lnames, err = gw.postFiles(post); err != nil {
 			return
 		}
 		var p string
@@ -237,7 +373,16 @@ func (gw *GhostWriter) parseSiteMeta() (err error) {
 	src := filepath.Join(gw.args.src, gw.args.config)
 	gw.log.Printf("Parsing site meta %v\n", src)
 	gw.site.meta = &SiteMeta{}
-	return gw.unyaml(src, gw.site.meta)
+	if err = gw.unyaml(src, gw.site.meta); err != nil {
+		return gw.buildError(src, err)
+	}
+	// Tag feeds are named after the site feeds, in the tag's directory.
+	feed := gw.site.meta.Feed
+	if gw.site.meta.TagsFormat != "" && feed.AtomPath != "" && feed.RssPath != "" && path.Base(feed.AtomPath) == path.Base(feed.RssPath) {
+		err = fmt.Errorf("Atom and RSS feeds are both named %v, so tag feeds would overwrite each other", path.Base(feed.AtomPath))
+		return gw.buildError(src, err)
+	}
+	return gw.buildError(src, gw.site.parseArchiveFormats())
 }
 
 // Parses root templates from the given template path.
@@ -254,6 +399,7 @@ func (gw *GhostWriter) parseTemplates() (err error) {
 	)
 	gw.rootTemplate = tmpl.NewTemplates()
 	gw.rootTemplate.SetFilesystem(gw.fs)
+	gw.archiveTemplate = ""
 	if names, err = gw.readDir(src); err != nil {
 		gw.log.Printf("Templates directory not found %v\n", src)
 		// Fail silently
@@ -276,9 +422,15 @@ func (gw *GhostWriter) parseTemplates() (err error) {
 			}
 			gw.tagsTemplate = text
 			gw.log.Printf("Found tags template with name %v\n", id)
+		} else if n == gw.args.archiveTemplate {
+			if text, err = gw.readFile(path); err != nil {
+				return
+			}
+			gw.archiveTemplate = text
+			gw.log.Printf("Found archive template with name %v\n", id)
 		} else {
 			if err = gw.rootTemplate.AddTemplateFromFile(path); err != nil {
-				return
+				return gw.buildError(path, err)
 			}
 			foundRoot = true
 			gw.log.Printf("Found root template with name %v\n", id)
@@ -342,18 +494,20 @@ func (gw *GhostWriter) readFile(path string) (out string, err error) {
 }
 
 // Renders miscellaneous files, including static content, into output dir.
+// Templates are rendered in order, static files are then copied in parallel.
 // Returns a non-nil error if something went wrong.
 func (gw *GhostWriter) renderMisc() (err error) {
 	var (
-		name  = gw.args.static
-		queue []string
-		names []string
-		p     string
-		n     string
-		src   string
-		dst   string
-		x     int
-		i     os.FileInfo
+		name   = gw.args.static
+		queue  []string
+		names  []string
+		static []string
+		p      string
+		n      string
+		src    string
+		dst    string
+		x      int
+		i      os.FileInfo
 	)
 	if queue, err = gw.readDir(gw.args.src); err != nil {
 		return
@@ -374,7 +528,8 @@ func (gw *GhostWriter) renderMisc() (err error) {
 			if name == p {
 				gw.log.Printf("Static dir not found %v\n", src)
 				// Fail silently
-				return nil
+				err = nil
+				break
 			}
 			return
 		}
@@ -408,27 +563,114 @@ func (gw *GhostWriter) renderMisc() (err error) {
 				if err = gw.renderTemplate(src, dst); err != nil {
 					return
 				}
-			default:
-				gw.log.Printf("Copying %v to %v\n", src, dst)
-				if _, err = gw.copyFile(src, dst); err != nil {
-					return
+				isNotFound := dst == filepath.Join(gw.args.dst, NOT_FOUND_PAGE)
+				if filepath.Ext(dst) == ".html" && !isNotFound {
+					gw.pages = append(gw.pages, gw.pageURL(dst))
 				}
+			default:
+				static = append(static, p)
 			}
 		}
 	}
+	return gw.parallel(len(static), func(x int) error {
+		p := static[x]
+		return gw.renderStatic(p, filepath.Join(gw.args.src, p), filepath.Join(gw.args.dst, p))
+	})
+}
+
+// Copies a static file from src to dst, unless it is unchanged since the
+// previous build.
+func (gw *GhostWriter) renderStatic(p string, src string, dst string) (err error) {
+	var (
+		key  = fmt.Sprintf("file:%v", p)
+		h    = sha256.New()
+		hash string
+	)
+	if err = gw.digestFile(h, src); err != nil {
+		return
+	}
+	if isJPEG(src) {
+		fmt.Fprintf(h, "exif:%v\n", gw.site.meta.Exif.Strip)
+	}
+	if hash = digestString(h); gw.cached(key, hash) != nil {
+		return
+	}
+	gw.log.Printf("Copying %v to %v\n", src, dst)
+	if _, err = gw.copyFile(src, dst); err != nil {
+		return
+	}
+	gw.record(key, hash, []string{dst})
 	return
 }
 
-// Renders all of the posts in the site.
+// Renders all of the posts in the site, in parallel.  Every body is rendered
+// before any page, since pages may show the bodies of other posts.
 func (gw *GhostWriter) renderPosts() (err error) {
 	var (
-		post *Post
+		ids []string
 	)
-	for _, post = range gw.site.Posts {
-		if err = gw.renderPost(post); err != nil {
-			return
+	for id := range gw.site.Posts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	err = gw.parallel(len(ids), func(i int) error {
+		return gw.renderPostBody(gw.site.Posts[ids[i]])
+	})
+	if err != nil {
+		return
+	}
+	gw.bodyDigest = gw.digestBodies()
+	return gw.parallel(len(ids), func(i int) error {
+		return gw.renderPostPage(gw.site.Posts[ids[i]])
+	})
+}
+
+// Calls fn for every index in [0, n) using up to args.jobs goroutines.
+// Returns the error for the lowest failing index, so that failures are
+// reported consistently regardless of scheduling.
+func (gw *GhostWriter) parallel(n int, fn func(i int) error) error {
+	var (
+		jobs  = gw.args.jobs
+		errs  = make([]error, n)
+		queue = make(chan int)
+		wg    sync.WaitGroup
+	)
+	if jobs < 1 {
+		jobs = 1
+	}
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// Generates the image variants declared by a post, skipping those which are
+// unchanged since the previous build.  Returns the paths of all variants.
+func (gw *GhostWriter) renderPostImages(post *Post, postpath string) (files []string, err error) {
+	for _, k := range post.imageKeys() {
+		var variants []string
+		img := post.images[k]
+		if variants, err = img.renderVariants(gw, postpath); err != nil {
+			return nil, gw.buildError(img.srcPath, err)
+		}
+		files = append(files, variants...)
+	}
 	return
 }
 
@@ -445,38 +687,47 @@ func (gw *GhostWriter) getFuncMap() *template.FuncMap {
 	}
 }
 
-// Renders the initalized Post object into an HTML file in the destination.
-func (gw *GhostWriter) renderPost(post *Post) (err error) {
+// Renders the body of the initalized Post object and copies its content into
+// the destination.
+func (gw *GhostWriter) renderPostBody(post *Post) (err error) {
 	var (
-		fdst     fauxfile.File
 		src      string
-		dst      string
 		postpath string
 		postbody string
 		body     *bytes.Buffer
-		writer   *bufio.Writer
 		tmpl     *template.Template
 		names    []string
+		variants []string
 		fmap     *template.FuncMap
 		index    int
-		str      string
+		key      string
+		hash     string
+		files    []string
+		entry    *ManifestEntry
 	)
 	if postpath, err = post.Path(); err != nil {
 		return
 	}
-	src = filepath.Join(post.SrcDir, "body.md")
-	dst = path.Join(gw.args.dst, postpath, "index.html")
+	key = fmt.Sprintf("post:%v", post.Id)
+	if hash, err = gw.digestPost(post); err != nil {
+		return
+	}
+	if entry = gw.cached(key, hash); entry != nil {
+		post.Body = entry.Body
+		post.Snippet = entry.Snippet
+		post.TOC = entry.TOC
+		// Carries the variants' manifest entries forward.
+		_, err = gw.renderPostImages(post, postpath)
+		return
+	}
+	src = gw.postBodySrc(post)
 	if postbody, err = gw.readFile(src); err != nil {
 		// A missing body is not an error, just assume a blank entry.
 		postbody = ""
 		err = nil
 	}
-	gw.fs.MkdirAll(path.Dir(dst), 0755)
-	if fdst, err = gw.fs.Create(dst); err != nil {
-		return
-	}
-	defer fdst.Close()
-	if names, err = gw.readDir(post.SrcDir); err != nil {
+	postbody = stripFrontMatter(postbody)
+	if names, err = gw.postFiles(post); err != nil {
 		return
 	}
 	for i := 0; i < len(names); i++ {
@@ -503,16 +754,25 @@ func (gw *GhostWriter) renderPost(post *Post) (err error) {
 			}
 			continue
 		}
-		switch filepath.Ext(name) {
-		case ".md":
-		case ".yaml":
+		switch {
+		case filepath.Ext(name) == ".md":
+		case filepath.Ext(name) == ".yaml":
+		case filepath.Join(post.SrcDir, name) == src:
 		default:
 			// Copy other files into destination-they're content.
 			s := filepath.Join(post.SrcDir, name)
 			d := filepath.Join(gw.args.dst, postpath, name)
-			gw.copyFile(s, d)
+			gw.fs.MkdirAll(filepath.Dir(d), 0755)
+			if _, err = gw.copyFile(s, d); err != nil {
+				return gw.buildError(s, err)
+			}
+			files = append(files, d)
 		}
 	}
+	if variants, err = gw.renderPostImages(post, postpath); err != nil {
+		return
+	}
+	files = append(files, variants...)
 
 	fmap = gw.getFuncMap()
 	(*fmap)["link"] = func(i string) string {
@@ -559,12 +819,27 @@ func (gw *GhostWriter) renderPost(post *Post) (err error) {
 			srcPath string = filepath.Join(post.SrcDir, path)
 			dstPath string = filepath.Join(postpath, path)
 		)
-		if img, ferr = NewImageData(gw.fs, srcPath, dstPath, gw.site.Root()); ferr != nil {
+		if img, ferr = NewImageData(gw.fs, gw.images, srcPath, dstPath, gw.site.Root()); ferr != nil {
 			ferr = fmt.Errorf("Could not load image metadata: %v", ferr)
 			return
 		}
 		return
 	}
+	(*fmap)["img"] = func(key string, sizes ...string) (out string, ferr error) {
+		var img *Image
+		if img, ferr = post.Image(key); ferr != nil {
+			return
+		}
+		return img.imgTag(strings.Join(sizes, ", ")), nil
+	}
+	(*fmap)["picture"] = func(key string, sizes ...string) (out string, ferr error) {
+		var img *Image
+		if img, ferr = post.Image(key); ferr != nil {
+			return
+		}
+		return img.pictureTag(strings.Join(sizes, ", ")), nil
+	}
+	(*fmap)["toc"] = tocMarker
 	(*fmap)["toyaml"] = func(in interface{}) (out string, ferr error) {
 		var outBytes []byte
 		if outBytes, ferr = yaml.Marshal(in); ferr != nil {
@@ -602,21 +877,61 @@ func (gw *GhostWriter) renderPost(post *Post) (err error) {
 			return
 		}
 		if tmpl, err = tmpl.Lookup("body").Funcs(*fmap).Parse(postbody); err != nil {
-			return
+			return gw.buildError(src, err)
 		}
 		body = new(bytes.Buffer)
 		if err = tmpl.Lookup("body").Execute(body, post); err != nil {
-			return
+			return gw.buildError(src, err)
 		}
 
-		// Render markdown
-		post.Body = string(blackfriday.Run(body.Bytes()))
+		// Render the body according to its format.
+		if post.Body, err = gw.renderBody(post, src, body.Bytes()); err != nil {
+			return gw.buildError(src, err)
+		}
+
+		// Give headings anchors and fill in tables of contents.
+		post.Body, post.TOC = buildTOC(post.Body)
+		post.Body = replaceTOCMarkers(post.Body, post.TOC)
 
 		// Check for snippet
 		if index = strings.Index(post.Body, "<!--BREAK-->"); index != -1 {
 			post.Snippet = post.Body[0:index]
 		}
 	}
+	entry = gw.record(key, hash, files)
+	entry.Body = post.Body
+	entry.Snippet = post.Snippet
+	entry.TOC = post.TOC
+	return
+}
+
+// Renders the initalized Post object into an HTML file in the destination.
+// Its body must already be rendered.
+func (gw *GhostWriter) renderPostPage(post *Post) (err error) {
+	var (
+		fdst     fauxfile.File
+		dst      string
+		postpath string
+		writer   *bufio.Writer
+		str      string
+		key      string
+		hash     string
+	)
+	if postpath, err = post.Path(); err != nil {
+		return
+	}
+	key = fmt.Sprintf("page:%v", post.Id)
+	hash = gw.digestPage(post)
+	if gw.cached(key, hash) != nil {
+		return
+	}
+	dst = path.Join(gw.args.dst, postpath, "index.html")
+	gw.fs.MkdirAll(path.Dir(dst), 0755)
+	if fdst, err = gw.fs.Create(dst); err != nil {
+		return
+	}
+	gw.track(dst)
+	defer fdst.Close()
 
 	// Render post into site template.
 	writer = bufio.NewWriter(fdst)
@@ -625,51 +940,50 @@ func (gw *GhostWriter) renderPost(post *Post) (err error) {
 		"Site": gw.site,
 	}
 	if str, err = gw.rootTemplate.RenderText(gw.postTemplate, data); err != nil {
-		return
+		return gw.buildError(gw.templatePath(gw.args.postTemplate), err)
 	}
 	writer.Write([]byte(str))
 	writer.Flush()
+	gw.record(key, hash, []string{dst})
 	return
 }
 
-// Renders all of the posts in the site.
+// Renders a listing page for every tag in the site.
 func (gw *GhostWriter) renderTags() (err error) {
 	var (
 		posts   Posts
 		tag     string
 		dst     string
 		tagpath string
-		writer  *bufio.Writer
-		fdst    fauxfile.File
-		str     string
+		key     string
+		hash    string
+		files   []string
 	)
 	if gw.tagsTemplate == "" {
 		return
 	}
 	for tag, posts = range gw.site.Tags {
+		key = fmt.Sprintf("tag:%v", tag)
+		hash = digestListing(gw.contentDigest, key)
+		if entry := gw.cached(key, hash); entry != nil {
+			gw.cachedPages(entry)
+			continue
+		}
 		tagpath = gw.site.TagPath(tag)
 		dst = path.Join(gw.args.dst, tagpath, "index.html")
-		gw.fs.MkdirAll(path.Dir(dst), 0755)
-		if fdst, err = gw.fs.Create(dst); err != nil {
-			return
-		}
-		defer fdst.Close()
-		writer = bufio.NewWriter(fdst)
 		sort.Sort(ByDateDesc{posts})
 		data := map[string]interface{}{
 			"Tag":   tag,
 			"Posts": posts,
 			"Site":  gw.site,
 		}
-		if str, err = gw.rootTemplate.RenderText(gw.tagsTemplate, data); err != nil {
-			return
-		}
-		writer.Write([]byte(str))
-		writer.Flush()
+		files, err = gw.renderPaged(tagpath, dst, data, func(d map[string]interface{}) (string, error) {
+			return gw.rootTemplate.RenderText(gw.tagsTemplate, d)
+		})
 		if err != nil {
-			return
+			return gw.buildError(gw.templatePath(gw.args.tagsTemplate), err)
 		}
-		fdst.Close()
+		gw.record(key, hash, files)
 	}
 	return
 }
@@ -677,23 +991,31 @@ func (gw *GhostWriter) renderTags() (err error) {
 // Renders a Go template from the given path to the output path.
 func (gw *GhostWriter) renderTemplate(src string, dst string) (err error) {
 	var (
-		writer *bufio.Writer
-		f      fauxfile.File
-		data   map[string]interface{}
-		str    string
+		base  string
+		data  map[string]interface{}
+		key   string
+		hash  string
+		files []string
 	)
-	if f, err = gw.fs.Create(dst); err != nil {
+	key = fmt.Sprintf("page:%v", src)
+	if hash, err = gw.digestTemplate(src); err != nil {
 		return
 	}
-	writer = bufio.NewWriter(f)
+	if entry := gw.cached(key, hash); entry != nil {
+		gw.cachedPages(entry)
+		return
+	}
+	base = strings.TrimSuffix(gw.pageURL(dst), ".html")
 	data = map[string]interface{}{
 		"Site": gw.site,
 	}
-	if str, err = gw.rootTemplate.RenderFile(src, data); err != nil {
-		return
+	files, err = gw.renderPaged(base, dst, data, func(d map[string]interface{}) (string, error) {
+		return gw.rootTemplate.RenderFile(src, d)
+	})
+	if err != nil {
+		return gw.buildError(src, err)
 	}
-	writer.Write([]byte(str))
-	writer.Flush()
+	gw.record(key, hash, files)
 	return
 }
 
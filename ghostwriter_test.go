@@ -15,14 +15,25 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/base64"
+	"encoding/json"
+	"fmt"
 	"github.com/kurrik/fauxfile"
+	"image"
+	"image/color"
+	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -55,6 +66,73 @@ func LooseCompareFile(t *testing.T, fs *fauxfile.MockFilesystem, path string, go
 	}
 }
 
+// Serializes access to fauxfile.MockFilesystem, which is not safe for
+// concurrent use, so that posts may be rendered in parallel.
+type lockedFilesystem struct {
+	mu sync.Mutex
+	fs fauxfile.Filesystem
+}
+
+func (l *lockedFilesystem) Chdir(dir string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Chdir(dir)
+}
+
+func (l *lockedFilesystem) Mkdir(name string, perm os.FileMode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Mkdir(name, perm)
+}
+
+func (l *lockedFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.MkdirAll(path, perm)
+}
+
+func (l *lockedFilesystem) Remove(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Remove(name)
+}
+
+func (l *lockedFilesystem) RemoveAll(path string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.RemoveAll(path)
+}
+
+func (l *lockedFilesystem) Rename(oldname string, newname string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Rename(oldname, newname)
+}
+
+func (l *lockedFilesystem) Create(name string) (fauxfile.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Create(name)
+}
+
+func (l *lockedFilesystem) Open(name string) (fauxfile.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Open(name)
+}
+
+func (l *lockedFilesystem) OpenFile(name string, flag int, perm os.FileMode) (fauxfile.File, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.OpenFile(name, flag, perm)
+}
+
+func (l *lockedFilesystem) Stat(name string) (os.FileInfo, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fs.Stat(name)
+}
+
 func Setup() (gw *GhostWriter, fs *fauxfile.MockFilesystem) {
 	fs = fauxfile.NewMockFilesystem()
 	fs.MkdirAll("/home/test", 0755)
@@ -62,7 +140,7 @@ func Setup() (gw *GhostWriter, fs *fauxfile.MockFilesystem) {
 	fs.Mkdir("src", 0755)
 	args := DefaultArgs()
 	args.dst = "build"
-	gw = NewGhostWriter(fs, args)
+	gw = NewGhostWriter(&lockedFilesystem{fs: fs}, args)
 	if SHOW_OUTPUT {
 		gw.log = log.New(os.Stdout, "", log.LstdFlags)
 	} else {
@@ -262,7 +340,7 @@ const POST_1_HTML = `
     <h1>Hello World!</h1>
     <div>
       <p>This is a fake post, for testing.</p>
-      <h2>This is markdown</h2>
+      <h2 id="this-is-markdown">This is markdown</h2>
       <p>This is just text content sans HTML.</p>
     </div>
     <a href="/2012-09-09/hello-again">Next Post</a>
@@ -337,7 +415,7 @@ const INDEX_HTML = `
     <h2>Hello World!</h2>
     <div>
       <p>This is a fake post, for testing.</p>
-      <h2>This is markdown</h2>
+      <h2 id="this-is-markdown">This is markdown</h2>
       <p>This is just text content sans HTML.</p>
     </div>
   </body>
@@ -370,7 +448,7 @@ func TestParseSiteMeta(t *testing.T) {
 func TestParsePostMeta(t *testing.T) {
 	gw, fs := Setup()
 	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
-	meta, err := gw.parsePostMeta("posts/01-test/meta.yaml")
+	meta, err := gw.parsePostMeta("src/posts/01-test/body.md", "src/posts/01-test/meta.yaml")
 	if err != nil {
 		t.Fatalf("parsePostMeta returned error: %v", err)
 	}
@@ -388,6 +466,406 @@ func TestParsePostMeta(t *testing.T) {
 	}
 }
 
+const FRONTMATTER_BODY = `---
+date: 2012-09-07
+slug: front-matter
+title: From front matter
+tags:
+  - front
+---
+Body after front matter.`
+
+// Ensures post metadata can come from front matter, and meta.yaml wins.
+func TestFrontMatter(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/posts/01-test/body.md", FRONTMATTER_BODY)
+	meta, err := gw.parsePostMeta("src/posts/01-test/body.md", "src/posts/01-test/meta.yaml")
+	if err != nil {
+		t.Fatalf("parsePostMeta returned error: %v", err)
+	}
+	if meta.Title != "From front matter" || meta.Slug != "front-matter" || meta.Tags[0] != "front" {
+		t.Errorf("Bad meta from front matter, got %+v", meta)
+	}
+	WriteFile(fs, "src/posts/01-test/meta.yaml", "title: From meta.yaml")
+	if meta, err = gw.parsePostMeta("src/posts/01-test/body.md", "src/posts/01-test/meta.yaml"); err != nil {
+		t.Fatalf("parsePostMeta returned error: %v", err)
+	}
+	if meta.Title != "From meta.yaml" || meta.Slug != "front-matter" || meta.Tags[0] != "front" {
+		t.Errorf("meta.yaml should override front matter, got %+v", meta)
+	}
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	if err = gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	body, err := ReadFile(fs, "build/2012-09-07/front-matter/index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(body, "<h1>From meta.yaml</h1>") || !strings.Contains(body, "<p>Body after front matter.</p>") {
+		t.Errorf("Unexpected post:\n%v", body)
+	}
+	if strings.Contains(body, "slug:") {
+		t.Errorf("Front matter should not be rendered:\n%v", body)
+	}
+}
+
+const SINGLEFILE_POST = `---
+date: 2012-09-08
+slug: quick-note
+title: Quick Note
+tags:
+  - hello
+images:
+  photo:
+    src: "note.png"
+---
+A note linking to [the first post]({{link "01-test"}}).
+
+{{img "photo"}}`
+
+// Ensures posts/<id>.md files with front matter are posts.
+func TestSingleFilePost(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", "See [the note]({{link \"note\"}}).")
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/note.md", SINGLEFILE_POST)
+	WriteFile(fs, "src/posts/README.md", "Not a post.")
+	WriteBase64File(fs, "src/posts/note.png", BASE64_IMAGE)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if len(gw.site.Posts) != 2 {
+		t.Errorf("Expected 2 posts, got %v", len(gw.site.Posts))
+	}
+	body, err := ReadFile(fs, "build/2012-09-08/quick-note/index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []string{
+		"<h1>Quick Note</h1>",
+		`<a href="/2012-09-07/hello-world">the first post</a>`,
+		`src="http://www.example.com/2012-09-08/quick-note/note.png"`,
+		`width="250" height="340"`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in:\n%v", expected, body)
+		}
+	}
+	if _, err = fs.Stat("build/2012-09-08/quick-note/note.png"); err != nil {
+		t.Errorf("Declared image should be copied: %v", err)
+	}
+	if _, err = fs.Stat("build/2012-09-08/quick-note/README.md"); err == nil {
+		t.Errorf("Other files in the posts directory should not be copied")
+	}
+	if body, _ = ReadFile(fs, "build/2012-09-07/hello-world/index.html"); !strings.Contains(body, `<a href="/2012-09-08/quick-note">the note</a>`) {
+		t.Errorf("Expected link to the note in:\n%v", body)
+	}
+	if body, _ = ReadFile(fs, "build/tags/hello/index.html"); !strings.Contains(body, "<h2>Quick Note</h2>") {
+		t.Errorf("Expected note in tag page:\n%v", body)
+	}
+}
+
+// Ensures post bodies are rendered according to the extension of their file.
+func TestBodyRenderers(t *testing.T) {
+	RegisterBodyRenderer("shout", func(post *Post, body []byte) (string, error) {
+		return "<p>" + strings.ToUpper(string(body)) + "!</p>", nil
+	})
+	defer unregisterBodyRenderer("shout")
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nrenderers:\n  rev:\n    command: [\"tr\", \"a-z\", \"A-Z\"]")
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-html/body.html", `<div class="x">{{.Title}}</div>`)
+	WriteFile(fs, "src/posts/01-html/meta.yaml", "date: 2012-09-01\nslug: html\ntitle: Html")
+	WriteFile(fs, "src/posts/02-text/body.txt", "if a < b && c\n  *not markdown*")
+	WriteFile(fs, "src/posts/02-text/meta.yaml", "date: 2012-09-02\nslug: text\ntitle: Text")
+	WriteFile(fs, "src/posts/03-shout/body.shout", "hello {{.Slug}}")
+	WriteFile(fs, "src/posts/03-shout/meta.yaml", "date: 2012-09-03\nslug: shout\ntitle: Shout")
+	WriteFile(fs, "src/posts/04-command.rev", "---\ndate: 2012-09-04\nslug: command\ntitle: Command\n---\npiped {{.Title}}")
+	WriteFile(fs, "src/posts/05-note.txt", "---\ndate: 2012-09-05\nslug: note\ntitle: Note\n---\nplain {{.Title}}")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for path, expected := range map[string]string{
+		"build/2012-09-01/html/index.html":    `<div class="x">Html</div>`,
+		"build/2012-09-02/text/index.html":    "<pre>if a &lt; b &amp;&amp; c\n  *not markdown*</pre>",
+		"build/2012-09-03/shout/index.html":   "<p>HELLO SHOUT!</p>",
+		"build/2012-09-04/command/index.html": "PIPED COMMAND",
+		"build/2012-09-05/note/index.html":    "<pre>plain Note</pre>",
+	} {
+		body, err := ReadFile(fs, path)
+		if err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in:\n%v", expected, body)
+		}
+	}
+	if _, err := fs.Stat("build/2012-09-01/html/body.html"); err == nil {
+		t.Errorf("Body file should not be copied")
+	}
+}
+
+// Documents the default Markdown options, which match blackfriday.Run.
+func TestMarkdownDefaults(t *testing.T) {
+	ext, flags, err := markdownOptions()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for name, on := range map[string]bool{
+		"no_intra_emphasis":          true,
+		"tables":                     true,
+		"fenced_code":                true,
+		"autolink":                   true,
+		"strikethrough":              true,
+		"lax_html_blocks":            false,
+		"space_headings":             true,
+		"hard_line_break":            false,
+		"tab_size_eight":             false,
+		"footnotes":                  false,
+		"no_empty_line_before_block": false,
+		"heading_ids":                true,
+		"titleblock":                 false,
+		"auto_heading_ids":           false,
+		"backslash_line_break":       true,
+		"definition_lists":           true,
+	} {
+		if (ext&MARKDOWN_EXTENSIONS[name] != 0) != on {
+			t.Errorf("Expected extension %v to default to %v", name, on)
+		}
+	}
+	for name, on := range map[string]bool{
+		"skip_html":                 false,
+		"skip_images":               false,
+		"skip_links":                false,
+		"safelink":                  false,
+		"nofollow_links":            false,
+		"noreferrer_links":          false,
+		"href_target_blank":         false,
+		"use_xhtml":                 true,
+		"footnote_return_links":     false,
+		"smartypants":               true,
+		"smartypants_fractions":     true,
+		"smartypants_dashes":        true,
+		"smartypants_latex_dashes":  true,
+		"smartypants_angled_quotes": false,
+		"smartypants_quotes_nbsp":   false,
+	} {
+		if (flags&MARKDOWN_FLAGS[name] != 0) != on {
+			t.Errorf("Expected flag %v to default to %v", name, on)
+		}
+	}
+	if len(MARKDOWN_EXTENSIONS) != 16 || len(MARKDOWN_FLAGS) != 15 {
+		t.Errorf("Defaults should be documented for every option")
+	}
+	if _, _, err = markdownOptions(&MarkdownMeta{Extensions: map[string]bool{"bogus": true}}); err == nil {
+		t.Errorf("Expected error for unknown extension")
+	}
+}
+
+const MARKDOWN_BODY = `## Intro {#start}
+
+Some is 3/8.
+Next line[^1].
+
+Term
+: Definition
+
+[^1]: A footnote.`
+
+// Ensures Markdown options from the site can be overridden by posts.
+func TestMarkdownOptions(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+`
+markdown:
+  extensions:
+    footnotes: true
+    definition_lists: false
+  flags:
+    smartypants_fractions: false`)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-site/body.md", MARKDOWN_BODY)
+	WriteFile(fs, "src/posts/01-site/meta.yaml", "date: 2012-09-01\nslug: site\ntitle: Site")
+	WriteFile(fs, "src/posts/02-post/body.md", MARKDOWN_BODY)
+	WriteFile(fs, "src/posts/02-post/meta.yaml", `date: 2012-09-02
+slug: post
+title: Post
+markdown:
+  extensions:
+    hard_line_break: true
+    footnotes: false
+  flags:
+    smartypants_fractions: true`)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	site, _ := ReadFile(fs, "build/2012-09-01/site/index.html")
+	post, _ := ReadFile(fs, "build/2012-09-02/post/index.html")
+	for _, c := range []struct {
+		body     string
+		expected string
+		present  bool
+	}{
+		{site, `<h2 id="start">Intro</h2>`, true},
+		{site, "Some is 3/8.", true},
+		{site, `class="footnotes"`, true},
+		{site, "<dl>", false},
+		{site, "<br />", false},
+		{post, "Some is <sup>3</sup>&frasl;<sub>8</sub>.<br />", true},
+		{post, `class="footnotes"`, false},
+		{post, "<dl>", false},
+	} {
+		if strings.Contains(c.body, c.expected) != c.present {
+			t.Errorf("Expected %q present=%v in:\n%v", c.expected, c.present, c.body)
+		}
+	}
+}
+
+const HIGHLIGHT_BODY = "```go{2}\nfunc main() {\n\tx := 1 < 2\n}\n```\n\n" +
+	"```{nosuchlang 1 nolinenos}\na <b> & c\n```\n\n" +
+	"```\nplain\n```\n"
+
+// Ensures fenced code blocks are highlighted on the server.
+func TestHighlight(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nhighlight:\n  linenumbers: true")
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", HIGHLIGHT_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	body, err := ReadFile(fs, "build/2012-09-07/hello-world/index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, c := range []struct {
+		expected string
+		present  bool
+	}{
+		{`<span class="kd">func</span>`, true},
+		{"<span class=\"lnt\">1\n</span>", true},
+		{`<span class="hl"><span class="lnt">2`, true},
+		{`<span class="line hl"><span class="cl">	<span class="nx">x</span>`, true},
+		{`<span class="p">&lt;</span>`, true},
+		{`<pre tabindex="0" class="chroma"><code><span class="line hl"><span class="cl">a &lt;b&gt; &amp; c`, true},
+		// Numbers are kept out of the code, so that copying it leaves them behind.
+		{`class="ln"`, false},
+		{`class="lntable"><tr><td class="lntd">` + "\n" + `<pre tabindex="0" class="chroma"><span class="lnt">1` + "\n</span></pre>", false},
+		{"<pre><code>plain\n</code></pre>", true},
+	} {
+		if strings.Contains(body, c.expected) != c.present {
+			t.Errorf("Expected %q present=%v in:\n%v", c.expected, c.present, body)
+		}
+	}
+}
+
+// Ensures the highlighting stylesheet can be written for a theme.
+func TestWriteStyles(t *testing.T) {
+	var out bytes.Buffer
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nhighlight:\n  theme: monokai")
+	if err := WriteStyles(gw, &out); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(out.String(), ".chroma .kd { color: #66d9ef }") {
+		t.Errorf("Expected monokai keywords in:\n%v", out.String())
+	}
+	gw.args.theme = "bogus"
+	if err := WriteStyles(gw, &out); err == nil {
+		t.Errorf("Expected error for unknown theme")
+	}
+}
+
+const TOC_BODY = `{{toc 2 3}}
+
+## Setup
+
+### Install *it*
+
+### Install *it*
+
+#### Deep
+
+## Usage {#setup-1}
+
+## Setup
+`
+
+// Ensures headings get unique anchors and are collected into a TOC.
+func TestTOC(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", `{{define "body"}}<nav>{{.Post.TOCList 3}}</nav>{{.Post.Body}}{{end}}`)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", TOC_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	post := gw.site.Posts["01-test"]
+	toc := post.TOC
+	if len(toc) != 3 || len(toc[0].Children) != 2 || len(toc[0].Children[1].Children) != 1 {
+		t.Fatalf("Unexpected TOC structure: %#v", toc)
+	}
+	for i, c := range []struct {
+		entry *TOCEntry
+		level int
+		text  string
+		id    string
+	}{
+		{toc[0], 2, "Setup", "setup"},
+		{toc[0].Children[0], 3, "Install it", "install-it"},
+		{toc[0].Children[1], 3, "Install it", "install-it-1"},
+		{toc[0].Children[1].Children[0], 4, "Deep", "deep"},
+		{toc[1], 2, "Usage", "setup-1"},
+		{toc[2], 2, "Setup", "setup-2"},
+	} {
+		if c.entry.Level != c.level || c.entry.Text != c.text || c.entry.ID != c.id {
+			t.Errorf("Entry %v: expected %v %q #%v, got %v %q #%v", i, c.level, c.text, c.id, c.entry.Level, c.entry.Text, c.entry.ID)
+		}
+	}
+	body, err := ReadFile(fs, "build/2012-09-07/hello-world/index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []string{
+		`<ul><li><a href="#setup">Setup</a><ul><li><a href="#install-it">Install it</a></li><li><a href="#install-it-1">Install it</a></li></ul></li><li><a href="#setup-1">Usage</a></li><li><a href="#setup-2">Setup</a></li></ul>`,
+		`<nav><ul><li><a href="#install-it">Install it</a></li><li><a href="#install-it-1">Install it</a><ul><li><a href="#deep">Deep</a></li></ul></li></ul></nav>`,
+		`<h3 id="install-it-1">Install <em>it</em></h3>`,
+		`<h2 id="setup-1">Usage</h2>`,
+		`<h2 id="setup-2">Setup</h2>`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in:\n%v", expected, body)
+		}
+	}
+
+	// Unchanged posts keep their TOC for other pages.
+	WriteFile(fs, "build/2012-09-07/hello-world/index.html", "stale")
+	WriteFile(fs, "src/index.tmpl", `{{define "body"}}{{range .Site.Posts}}{{.TOCList 2 2}}{{end}}{{end}}`)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/2012-09-07/hello-world/index.html", "stale")
+	expected := `<ul><li><a href="#setup">Setup</a></li><li><a href="#setup-1">Usage</a></li><li><a href="#setup-2">Setup</a></li></ul>`
+	if index, _ := ReadFile(fs, "build/index.html"); !strings.Contains(index, expected) {
+		t.Errorf("Expected %q in:\n%v", expected, index)
+	}
+}
+
 // Ensures that static files are copied to the appropriate build locations.
 func TestFilesCopiedToBuild(t *testing.T) {
 	gw, fs := Setup()
@@ -845,3 +1323,1568 @@ func TestPostImagesValid(t *testing.T) {
 	}
 	LooseCompareFile(t, fs, "build/2017-09-17/postimages/index.html", POSTIMAGES_VALID_HTML)
 }
+
+const GENERATEDIMAGES_META = `
+date: 2017-09-17
+slug: postimages
+title: Post Images
+images:
+  image01:
+    src: "image01.png"
+    variants:
+      thumb:
+        width: 125
+      square:
+        width: 100
+        height: 100
+        fit: cover
+      large:
+        width: 1000
+`
+
+const GENERATEDIMAGES_BODY = `
+{{with .Image "image01"}}{{range $k, $v := .Variants}}
+{{$k}} {{$v.Path}} {{$v.Width}}x{{$v.Height}}
+{{end}}{{end}}`
+
+func TestGeneratedImageVariants(t *testing.T) {
+	var (
+		dir   = "build/2017-09-17/postimages/"
+		sizes = map[string][2]int{
+			"image01.thumb.png":  {125, 170},
+			"image01.square.png": {100, 100},
+			"image01.large.png":  {250, 340},
+		}
+	)
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", GENERATEDIMAGES_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", GENERATEDIMAGES_META)
+	WriteBase64File(fs, "src/posts/01-test/image01.png", BASE64_IMAGE)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for name, size := range sizes {
+		f, err := fs.Open(dir + name)
+		if err != nil {
+			t.Fatalf("Variant %v should be generated: %v", name, err)
+		}
+		config, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Could not decode %v: %v", name, err)
+		}
+		if config.Width != size[0] || config.Height != size[1] {
+			t.Errorf("Variant %v is %vx%v, expected %vx%v", name, config.Width, config.Height, size[0], size[1])
+		}
+	}
+	body, err := ReadFile(fs, dir+"index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, expected := range []string{
+		"thumb /2017-09-17/postimages/image01.thumb.png 125x170",
+		"square /2017-09-17/postimages/image01.square.png 100x100",
+		"large /2017-09-17/postimages/image01.large.png 250x340",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %q in:\n%v", expected, body)
+		}
+	}
+
+	// Variants are only regenerated when their source changes, even after
+	// builds in which the post itself was unchanged.
+	WriteFile(fs, dir+"image01.thumb.png", "stale")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	WriteFile(fs, "src/posts/01-test/body.md", GENERATEDIMAGES_BODY+"\nMore.")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, dir+"image01.thumb.png", "stale")
+}
+
+const RESPONSIVEIMAGES_META = `
+date: 2017-09-17
+slug: responsive
+title: Responsive
+images:
+  image01:
+    src: "image01.png"
+    variants:
+      small:
+        width: 125
+      square:
+        width: 100
+        fit: cover
+        height: 100
+      photo:
+        src: "image01.jpg"
+    metadata:
+      alt: 'A "test" image'
+`
+
+const RESPONSIVEIMAGES_BODY = `
+{{img "image01"}}
+
+{{picture "image01" "(min-width: 800px) 50vw" "100vw"}}`
+
+const RESPONSIVEIMAGES_VALID_HTML = `<!DOCTYPE html>
+<html>
+  <head>
+  <title>Test blog - Responsive</title>
+  <link rel="canonical" href="http://www.example.com/2017-09-17/responsive" />
+  </head>
+  <body>
+    <h1>Responsive</h1>
+    <div>
+      <p><img src="http://www.example.com/2017-09-17/responsive/image01.png"
+        srcset="http://www.example.com/2017-09-17/responsive/image01.small.png 125w, http://www.example.com/2017-09-17/responsive/image01.png 250w"
+        sizes="(max-width: 250px) 100vw, 250px"
+        width="250" height="340" alt="A &#34;test&#34; image" loading="lazy"></p>
+      <p><picture><source type="image/jpeg"
+        srcset="http://www.example.com/2017-09-17/responsive/image01.jpg 50w"
+        sizes="(min-width: 800px) 50vw, 100vw"><img src="http://www.example.com/2017-09-17/responsive/image01.png"
+        srcset="http://www.example.com/2017-09-17/responsive/image01.small.png 125w, http://www.example.com/2017-09-17/responsive/image01.png 250w"
+        sizes="(min-width: 800px) 50vw, 100vw"
+        width="250" height="340" alt="A &#34;test&#34; image" loading="lazy"></picture></p>
+    </div>
+  </body>
+</html>`
+
+func TestResponsiveImages(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 50, 68)), nil); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", RESPONSIVEIMAGES_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", RESPONSIVEIMAGES_META)
+	WriteBase64File(fs, "src/posts/01-test/image01.png", BASE64_IMAGE)
+	WriteFileBytes(fs, "src/posts/01-test/image01.jpg", photo.Bytes())
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/2017-09-17/responsive/index.html", RESPONSIVEIMAGES_VALID_HTML)
+}
+
+// Ensures <picture> sources are ordered by preference, since browsers use the
+// first one they support.
+func TestPictureSourceOrder(t *testing.T) {
+	data := func(name string) ImageData {
+		return ImageData{Width: 100, Height: 50, Path: "/" + name, Permalink: "http://www.example.com/" + name}
+	}
+	img := &Image{
+		data: data("a.gif"),
+		variants: map[string]ImageData{
+			"a": data("a.jpg"),
+			"b": data("a.webp"),
+			"c": data("a.png"),
+			"d": data("a.avif"),
+		},
+	}
+	var (
+		html = img.pictureTag("")
+		last = -1
+	)
+	for _, ctype := range []string{"image/avif", "image/webp", "image/jpeg", "image/png"} {
+		index := strings.Index(html, fmt.Sprintf(`<source type="%v"`, ctype))
+		if index <= last {
+			t.Errorf("Expected %v source after the previous one in:\n%v", ctype, html)
+		}
+		last = index
+	}
+}
+
+// A single field of a test EXIF directory.
+type exifTag struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func exifASCII(tag uint16, s string) exifTag {
+	return exifTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func exifShort(tag uint16, v uint16) exifTag {
+	return exifTag{tag, 3, 1, []byte{byte(v >> 8), byte(v)}}
+}
+
+func exifRationals(tag uint16, values ...uint32) exifTag {
+	var data []byte
+	for _, v := range values {
+		data = append(data, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return exifTag{tag, 5, uint32(len(values) / 2), data}
+}
+
+// Serializes big endian TIFF data with the given IFD0, EXIF and GPS
+// directories, adding pointers to the latter two if they are not empty.
+func buildTIFF(ifd0 []exifTag, sub []exifTag, gps []exifTag) []byte {
+	var (
+		ifdSize = func(n int) int { return 2 + 12*n + 4 }
+		subOff  int
+		gpsOff  int
+		out     []byte
+		data    []byte
+		dataOff int
+	)
+	pointers := 0
+	if len(sub) > 0 {
+		pointers++
+	}
+	if len(gps) > 0 {
+		pointers++
+	}
+	subOff = 8 + ifdSize(len(ifd0)+pointers)
+	gpsOff = subOff + ifdSize(len(sub))
+	dataOff = gpsOff + ifdSize(len(gps))
+	if len(sub) > 0 {
+		ifd0 = append(ifd0, exifTag{0x8769, 4, 1, []byte{0, 0, byte(subOff >> 8), byte(subOff)}})
+	}
+	if len(gps) > 0 {
+		ifd0 = append(ifd0, exifTag{0x8825, 4, 1, []byte{0, 0, byte(gpsOff >> 8), byte(gpsOff)}})
+	}
+	out = []byte("MM\x00\x2a\x00\x00\x00\x08")
+	for _, ifd := range [][]exifTag{ifd0, sub, gps} {
+		out = append(out, byte(len(ifd)>>8), byte(len(ifd)))
+		for _, t := range ifd {
+			out = append(out, byte(t.tag>>8), byte(t.tag), byte(t.typ>>8), byte(t.typ))
+			out = append(out, byte(t.count>>24), byte(t.count>>16), byte(t.count>>8), byte(t.count))
+			if len(t.data) <= 4 {
+				out = append(out, append(t.data, make([]byte, 4-len(t.data))...)...)
+				continue
+			}
+			p := dataOff + len(data)
+			out = append(out, byte(p>>24), byte(p>>16), byte(p>>8), byte(p))
+			data = append(data, t.data...)
+		}
+		out = append(out, 0, 0, 0, 0)
+	}
+	return append(out, data...)
+}
+
+// Returns a w by h JPEG, red on the left half and blue on the right, with
+// the given TIFF data as its EXIF segment.
+func exifJPEG(t *testing.T, w int, h int, tiff []byte) []byte {
+	var (
+		b   bytes.Buffer
+		img = image.NewRGBA(image.Rect(0, 0, w, h))
+	)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if x < w/2 {
+				img.Set(x, y, color.RGBA{255, 0, 0, 255})
+			} else {
+				img.Set(x, y, color.RGBA{0, 0, 255, 255})
+			}
+		}
+	}
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	out = append(out, segment...)
+	return append(out, b.Bytes()[2:]...)
+}
+
+// XMP packet with a location, as written by phones and photo editors.
+const EXIF_XMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="37,46.5N" exif:GPSLongitude="122,25.1667W"/>` +
+	`</rdf:RDF></x:xmpmeta>`
+
+// Returns the JPEG in data with an XMP segment holding packet inserted
+// after its start of image marker.
+func withXMP(data []byte, packet string) []byte {
+	segment := append([]byte("http://ns.adobe.com/xap/1.0/\x00"), packet...)
+	out := []byte{0xff, 0xd8, 0xff, 0xe1, byte((len(segment) + 2) >> 8), byte(len(segment) + 2)}
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+const EXIF_META = `
+date: 2017-09-17
+slug: exif
+title: Exif
+images:
+  photo:
+    src: "photo.jpg"
+    variants:
+      thumb:
+        width: 10
+`
+
+const EXIF_BODY = `{{with (.Image "photo").Data}}{{.Width}}x{{.Height}} {{.Exif.Model}} {{urlquery .Exif.Exposure}} {{.Exif.FocalLength}} {{.Exif.Taken.Format "2006-01-02T15:04"}} {{printf "%.4f,%.4f" .Exif.GPS.Latitude .Exif.GPS.Longitude}}{{end}}`
+
+func TestImageExif(t *testing.T) {
+	var (
+		dir  = "build/2017-09-17/exif/"
+		tiff = buildTIFF(
+			[]exifTag{
+				exifASCII(0x010f, "Phone Co"),
+				exifASCII(0x0110, "Phone 1"),
+				exifShort(0x0112, 6),
+			},
+			[]exifTag{
+				exifRationals(0x829a, 1, 125),
+				exifASCII(0x9003, "2017:09:17 12:30:00"),
+				exifASCII(0x9011, "-07:00"),
+				exifRationals(0x920a, 42, 10),
+			},
+			[]exifTag{
+				exifASCII(0x0001, "N"),
+				exifRationals(0x0002, 37, 1, 46, 1, 30, 1),
+				exifASCII(0x0003, "W"),
+				exifRationals(0x0004, 122, 1, 25, 1, 10, 1),
+			},
+		)
+	)
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nexif:\n  strip: gps")
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", EXIF_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", EXIF_META)
+	WriteFileBytes(fs, "src/posts/01-test/photo.jpg", withXMP(exifJPEG(t, 40, 20, tiff), EXIF_XMP))
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	body, err := ReadFile(fs, dir+"index.html")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := "20x40 Phone 1 1%2F125 4.2 2017-09-17T12:30 37.7750,-122.4194"
+	if !strings.Contains(body, expected) {
+		t.Errorf("Expected %q in:\n%v", expected, body)
+	}
+
+	// Variants are rotated upright, moving the left of the photo to the top.
+	f, err := fs.Open(dir + "photo.thumb.jpg")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	thumb, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if size := thumb.Bounds().Size(); size.X != 10 || size.Y != 20 {
+		t.Errorf("Thumbnail is %vx%v, expected 10x20", size.X, size.Y)
+	}
+	if r, _, b, _ := thumb.At(5, 2).RGBA(); r>>8 < 200 || b>>8 > 60 {
+		t.Errorf("Top of thumbnail should be red")
+	}
+	if r, _, b, _ := thumb.At(5, 17).RGBA(); r>>8 > 60 || b>>8 < 200 {
+		t.Errorf("Bottom of thumbnail should be blue")
+	}
+
+	// Location is removed from the copied photo.
+	f, err = fs.Open(dir + "photo.jpg")
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	exif := readExif(f)
+	f.Close()
+	if exif == nil || exif.Model != "Phone 1" || exif.GPS != nil {
+		t.Errorf("Expected EXIF without GPS, got %+v", exif)
+	}
+	if data, _ := ReadFile(fs, dir+"photo.jpg"); strings.Contains(data, "GPSLatitude") {
+		t.Errorf("Location in XMP should be removed")
+	}
+
+	// Locations are not cached, but are still available to templates.
+	if _, err := fs.Stat("build/" + IMAGE_CACHE_NAME); err == nil {
+		t.Errorf("Image cache should not be published")
+	}
+	cache, err := ReadFile(fs, path.Join(gw.cacheDir(), IMAGE_CACHE_NAME))
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !strings.Contains(cache, `"HasGPS":true`) || strings.Contains(cache, "Latitude") || strings.Contains(cache, "37.77") {
+		t.Errorf("Expected no coordinates in image cache:\n%v", cache)
+	}
+	WriteFile(fs, "src/posts/01-test/body.md", EXIF_BODY+"\n")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if body, _ = ReadFile(fs, dir+"index.html"); !strings.Contains(body, expected) {
+		t.Errorf("Expected %q from cached image in:\n%v", expected, body)
+	}
+
+	// Stripping everything keeps only the orientation.
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nexif:\n  strip: all")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if f, err = fs.Open(dir + "photo.jpg"); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	exif = readExif(f)
+	f.Seek(0, io.SeekStart)
+	_, _, decodeErr := image.Decode(f)
+	f.Close()
+	if exif == nil || exif.Orientation != 6 || exif.Model != "" || !exif.Taken.IsZero() {
+		t.Errorf("Expected only orientation, got %+v", exif)
+	}
+	if decodeErr != nil {
+		t.Errorf("Stripped photo should decode: %v", decodeErr)
+	}
+}
+
+// Ensures malformed GPS pointers leave the EXIF data alone.
+func TestScrubGPSPointer(t *testing.T) {
+	var (
+		tiff = buildTIFF([]exifTag{
+			exifASCII(0x0110, "Phone 1"),
+			exifTag{0x8825, 4, 1, []byte{0, 0, 0, 0}},
+		}, nil, nil)
+		data = append([]byte{}, tiff...)
+	)
+	if err := scrubGPS(data); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if !bytes.Equal(data, tiff) {
+		t.Errorf("EXIF data should be unchanged, got %q", data)
+	}
+}
+
+// Ensures image sizes are cached between builds until the file changes.
+func TestImageCache(t *testing.T) {
+	var (
+		dir = "build/2017-09-17/postimages/"
+		src = "src/posts/01-test/image01.png"
+	)
+	gw, fs := Setup()
+	cache := path.Join(gw.cacheDir(), IMAGE_CACHE_NAME)
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/renderimage.tmpl", RENDERIMAGE_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POSTIMAGES_BODY)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POSTIMAGES_META)
+	WriteBase64File(fs, src, BASE64_IMAGE)
+	WriteBase64File(fs, "src/posts/01-test/image02.png", BASE64_IMAGE)
+	WriteBase64File(fs, "src/posts/01-test/image02_thumb.png", BASE64_IMAGE)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	data, err := ReadFile(fs, cache)
+	if err != nil {
+		t.Fatalf("Image cache should be written: %v", err)
+	}
+	images := NewImageCache()
+	if err = json.Unmarshal([]byte(data), images); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	probe, ok := images.Entries[src]
+	if !ok || probe.Width != 250 || probe.Height != 340 {
+		t.Fatalf("Expected 250x340 entry for %v in %v", src, data)
+	}
+
+	// Cached sizes are used while the file is unchanged.
+	probe.Width = 25
+	probe.Height = 34
+	encoded, _ := json.Marshal(images)
+	WriteFile(fs, cache, string(encoded))
+	WriteFile(fs, "src/posts/01-test/body.md", POSTIMAGES_BODY+"\n")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if body, _ := ReadFile(fs, dir+"index.html"); !strings.Contains(body, `width="25" height="34"`) {
+		t.Errorf("Expected cached size in:\n%v", body)
+	}
+
+	// Changed files are read again.
+	WriteBase64File(fs, src, BASE64_IMAGE)
+	WriteFile(fs, "src/posts/01-test/body.md", POSTIMAGES_BODY)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if body, _ := ReadFile(fs, dir+"index.html"); strings.Contains(body, `width="25"`) {
+		t.Errorf("Expected updated size in:\n%v", body)
+	}
+}
+
+const FEED_SITE_META = `
+title: Test blog
+root: http://www.example.com
+author: Test Author
+email: test@example.com
+pathformat: /{{.DatePath}}/{{.Slug}}
+dateformat: "2006-01-02"
+tagsformat: /tags/{{.Tag}}
+recentcount: 5
+feed:
+  count: 1
+  atompath: /feed.atom
+  rsspath: /feed.rss`
+
+const FEED_ATOM = `<?xml version="1.0" encoding="UTF-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Test blog</title>
+  <id>http://www.example.com/feed.atom</id>
+  <link rel="self" href="http://www.example.com/feed.atom"></link>
+  <link rel="alternate" href="http://www.example.com/"></link>
+  <updated>2012-09-09T00:00:00Z</updated>
+  <author>
+    <name>Test Author</name>
+    <email>test@example.com</email>
+  </author>
+  <entry>
+    <title>Hello Again!</title>
+    <id>http://www.example.com/2012-09-09/hello-again</id>
+    <link rel="alternate" href="http://www.example.com/2012-09-09/hello-again"></link>
+    <published>2012-09-09T00:00:00Z</published>
+    <updated>2012-09-09T00:00:00Z</updated>
+    <content type="html">&lt;p&gt;This is a &lt;a href=&#34;/2012-09-07/hello-world&#34;&gt;link&lt;/a&gt; to a post.&#xA;&lt;img src=&#34;/2012-09-07/hello-world/img.png&#34; /&gt;&lt;/p&gt;&#xA;&#xA;</content>
+  </entry>
+</feed>`
+
+const FEED_RSS = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0">
+  <channel>
+    <title>Test blog</title>
+    <link>http://www.example.com/</link>
+    <description>Test blog</description>
+    <managingEditor>test@example.com (Test Author)</managingEditor>
+    <lastBuildDate>Sun, 09 Sep 2012 00:00:00 +0000</lastBuildDate>
+    <item>
+      <title>Hello Again!</title>
+      <link>http://www.example.com/2012-09-09/hello-again</link>
+      <guid isPermaLink="true">http://www.example.com/2012-09-09/hello-again</guid>
+      <pubDate>Sun, 09 Sep 2012 00:00:00 +0000</pubDate>
+      <author>test@example.com (Test Author)</author>
+      <description>&lt;p&gt;This is a &lt;a href=&#34;/2012-09-07/hello-world&#34;&gt;link&lt;/a&gt; to a post.&#xA;&lt;img src=&#34;/2012-09-07/hello-world/img.png&#34; /&gt;&lt;/p&gt;&#xA;&#xA;</description>
+    </item>
+  </channel>
+</rss>`
+
+// Ensures Atom and RSS feeds are rendered with escaped content.
+func TestFeeds(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", FEED_SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/01-test/img.png", "")
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/feed.atom", FEED_ATOM)
+	LooseCompareFile(t, fs, "build/feed.rss", FEED_RSS)
+	if p := gw.site.TagFeedPath("world"); p != "/tags/world/feed.atom" {
+		t.Errorf("Bad tag feed path, got %v", p)
+	}
+	if out, err := ReadFile(fs, "build/tags/world/feed.atom"); err != nil {
+		t.Errorf("Error reading tag feed: %v", err)
+	} else if !strings.Contains(out, "<title>Hello World!</title>") {
+		t.Errorf("Tag feed missing post:\n%v", out)
+	}
+	if _, err := ReadFile(fs, "build/tags/world/feed.rss"); err != nil {
+		t.Errorf("Error reading tag feed: %v", err)
+	}
+
+	// Tag feeds would be written to the same file.
+	meta := strings.Replace(FEED_SITE_META, "/feed.atom", "/atom/feed.xml", 1)
+	WriteFile(fs, "src/config.yaml", strings.Replace(meta, "/feed.rss", "/rss/feed.xml", 1))
+	if err := gw.Process(); err == nil || !strings.Contains(err.Error(), "feed.xml") {
+		t.Errorf("Expected an error for tag feeds sharing a name, got %v", err)
+	}
+}
+
+const SITEMAP_SITE_META = `
+title: Test blog
+root: http://www.example.com
+pathformat: /{{.DatePath}}/{{.Slug}}
+dateformat: "2006-01-02"
+tagsformat: /tags/{{.Tag}}
+sitemap:
+  path: /sitemap.xml
+robots:
+  path: /robots.txt
+  disallow:
+    - /tags/world`
+
+const SITEMAP_POST_2_META = `
+date: 2012-09-09
+updated: 2012-10-01
+slug: hello-again
+title: Hello Again!
+tags:
+  - hello`
+
+const SITEMAP_XML = `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url>
+    <loc>http://www.example.com/</loc>
+  </url>
+  <url>
+    <loc>http://www.example.com/2012-09-07/hello-world</loc>
+    <lastmod>2012-09-07</lastmod>
+  </url>
+  <url>
+    <loc>http://www.example.com/2012-09-09/hello-again</loc>
+    <lastmod>2012-10-01</lastmod>
+  </url>
+  <url>
+    <loc>http://www.example.com/about.html</loc>
+  </url>
+  <url>
+    <loc>http://www.example.com/tags/hello</loc>
+    <lastmod>2012-10-01</lastmod>
+  </url>
+</urlset>`
+
+const ROBOTS_TXT = `User-agent: *
+Disallow: /tags/world
+
+Sitemap: http://www.example.com/sitemap.xml
+`
+
+// Ensures sitemap.xml and robots.txt are generated.
+func TestSitemap(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITEMAP_SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", SITEMAP_POST_2_META)
+	WriteFile(fs, "src/index.tmpl", INDEX_TMPL)
+	WriteFile(fs, "src/about.tmpl", "")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/sitemap.xml", SITEMAP_XML)
+	if out, _ := ReadFile(fs, "build/robots.txt"); out != ROBOTS_TXT {
+		t.Errorf("Read:\n%v\nExpected:\n%v", out, ROBOTS_TXT)
+	}
+
+	// The sitemap has a default path, and posts with an invalid update date
+	// are rejected instead of silently using the post date.
+	WriteFile(fs, "src/config.yaml", strings.Replace(SITEMAP_SITE_META, "sitemap:\n  path: /sitemap.xml\n", "", 1))
+	WriteFile(fs, "src/posts/02-test/meta.yaml", strings.Replace(SITEMAP_POST_2_META, "2012-10-01", "October 1st", 1))
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if out, err := ReadFile(fs, "build/sitemap.xml"); err != nil {
+		t.Errorf("Sitemap should be written by default: %v", err)
+	} else if strings.Contains(out, "hello-again") {
+		t.Errorf("Post with an invalid update date should be rejected:\n%v", out)
+	}
+	if out, _ := ReadFile(fs, "build/robots.txt"); !strings.Contains(out, "Sitemap: http://www.example.com/sitemap.xml") {
+		t.Errorf("Expected default sitemap in:\n%v", out)
+	}
+}
+
+const PAGINATE_SITE_META = `
+title: Test blog
+root: http://www.example.com
+pathformat: /{{.DatePath}}/{{.Slug}}
+dateformat: "2006-01-02"
+tagsformat: /tags/{{.Tag}}
+pagesize: 1
+sitemap:
+  path: /sitemap.xml`
+
+const PAGINATE_TMPL = `
+{{define "body"}}
+  {{$page := .Pager.Paginate .Site.PostsByDate}}
+  {{range $page.Posts}}<h2>{{.Title}}</h2>{{end}}
+  <p>Page {{$page.Current.Number}} of {{$page.Total}}</p>
+  {{range $page.Pages}}<a href="{{.Path}}">{{.Number}}</a>{{end}}
+  {{with $page.Prev}}<a href="{{.Path}}">Prev</a>{{end}}
+  {{with $page.Next}}<a href="{{.Path}}">Next</a>{{end}}
+{{end}}`
+
+const PAGINATE_TAGS_TMPL = `
+{{define "body"}}
+  {{$page := .Pager.Paginate .Posts}}
+  {{range $page.Posts}}<h2>{{.Title}}</h2>{{end}}
+  {{with $page.Next}}<a href="{{.Path}}">Next</a>{{end}}
+{{end}}`
+
+const PAGINATE_PAGE_1_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h2>Hello Again!</h2>
+    <p>Page 1 of 2</p>
+    <a href="/">1</a><a href="/page/2/">2</a>
+    <a href="/page/2/">Next</a>
+  </body>
+</html>`
+
+const PAGINATE_PAGE_2_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h2>Hello World!</h2>
+    <p>Page 2 of 2</p>
+    <a href="/">1</a><a href="/page/2/">2</a>
+    <a href="/">Prev</a>
+  </body>
+</html>`
+
+const PAGINATE_TAG_PAGE_1_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h2>Hello Again!</h2>
+    <a href="/tags/hello/page/2/">Next</a>
+  </body>
+</html>`
+
+const PAGINATE_TAG_PAGE_2_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h2>Hello World!</h2>
+  </body>
+</html>`
+
+// Ensures templates which paginate a list of posts render every page.
+func TestPagination(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", PAGINATE_SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", PAGINATE_TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	WriteFile(fs, "src/index.tmpl", PAGINATE_TMPL)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/index.html", PAGINATE_PAGE_1_HTML)
+	LooseCompareFile(t, fs, "build/page/2/index.html", PAGINATE_PAGE_2_HTML)
+	LooseCompareFile(t, fs, "build/tags/hello/index.html", PAGINATE_TAG_PAGE_1_HTML)
+	LooseCompareFile(t, fs, "build/tags/hello/page/2/index.html", PAGINATE_TAG_PAGE_2_HTML)
+	if _, err := fs.Stat("build/page/3"); err == nil {
+		t.Errorf("Rendered too many pages")
+	}
+	// Later pages stay in the sitemap when their listings are unchanged.
+	for i := 0; i < 2; i++ {
+		sitemap, _ := ReadFile(fs, "build/sitemap.xml")
+		for _, loc := range []string{
+			"<loc>http://www.example.com/page/2/</loc>",
+			"<loc>http://www.example.com/tags/hello/page/2/</loc>",
+		} {
+			if !strings.Contains(sitemap, loc) {
+				t.Errorf("Build %v: expected %v in sitemap:\n%v", i+1, loc, sitemap)
+			}
+		}
+		if err := gw.Process(); err != nil {
+			t.Fatalf("Error: %v", err)
+		}
+	}
+}
+
+const ARCHIVE_POST_3_META = `
+date: 2013-01-15
+slug: new-year
+title: New Year`
+
+const ARCHIVE_TMPL = `
+{{define "body"}}
+  <h1>{{.Year}} {{.MonthName}}</h1>
+  {{range .Posts}}<h2>{{.Title}}</h2>{{end}}
+{{end}}`
+
+const ARCHIVE_INDEX_TMPL = `
+{{define "body"}}
+  {{range .Site.Years}}
+    <a href="{{$.Site.ArchivePath . 0}}">{{.}}</a>
+    {{$year := .}}
+    {{range $.Site.Months .}}
+      <a href="{{$.Site.ArchivePath $year .}}">{{len ($.Site.PostsIn $year .)}}</a>
+    {{end}}
+  {{end}}
+{{end}}`
+
+const ARCHIVE_INDEX_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <a href="/2013/">2013</a>
+    <a href="/2013/01/">1</a>
+    <a href="/2012/">2012</a>
+    <a href="/2012/09/">2</a>
+  </body>
+</html>`
+
+const ARCHIVE_2012_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h1>2012</h1>
+    <h2>Hello Again!</h2>
+    <h2>Hello World!</h2>
+  </body>
+</html>`
+
+const ARCHIVE_2013_01_HTML = `
+<!DOCTYPE html>
+<html>
+  <head>
+    <title>Test blog</title>
+  </head>
+  <body>
+    <h1>2013 January</h1>
+    <h2>New Year</h2>
+  </body>
+</html>`
+
+// Ensures year and month archive pages are rendered.
+func TestArchives(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/archive.tmpl", ARCHIVE_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	WriteFile(fs, "src/posts/03-test/meta.yaml", ARCHIVE_POST_3_META)
+	WriteFile(fs, "src/index.tmpl", ARCHIVE_INDEX_TMPL)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, "build/index.html", ARCHIVE_INDEX_HTML)
+	LooseCompareFile(t, fs, "build/2012/index.html", ARCHIVE_2012_HTML)
+	LooseCompareFile(t, fs, "build/2013/01/index.html", ARCHIVE_2013_01_HTML)
+
+	// Mistakes in the formats are reported rather than crashing the build.
+	for _, format := range []string{"yearformat: /{{.Year}", "monthformat: /{{template \"x\"}}/"} {
+		WriteFile(fs, "src/config.yaml", SITE_META+"\n"+format)
+		if err := gw.Process(); err == nil {
+			t.Errorf("Expected an error for %v", format)
+		}
+	}
+}
+
+const DRAFT_POST_META = `
+date: 2012-09-10
+slug: draft
+title: Work In Progress
+draft: true
+tags:
+  - hello`
+
+// Ensures drafts are skipped unless requested, and marked when included.
+func TestDrafts(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/01-test/img.png", "")
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	WriteFile(fs, "src/posts/03-draft/meta.yaml", DRAFT_POST_META)
+	WriteFile(fs, "src/index.tmpl", INDEX_TMPL)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := fs.Stat("build/2012-09-10/draft/index.html"); err == nil {
+		t.Errorf("Draft post should not be rendered")
+	}
+	LooseCompareFile(t, fs, "build/index.html", INDEX_HTML)
+	LooseCompareFile(t, fs, "build/2012-09-09/hello-again/index.html", POST_2_HTML)
+	LooseCompareFile(t, fs, "build/tags/hello/index.html", TAG_HELLO_HTML)
+
+	gw.args.drafts = true
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	post, ok := gw.site.Posts["03-draft"]
+	if !ok {
+		t.Fatalf("Draft post should be parsed with drafts enabled")
+	}
+	if post.Title() != "[DRAFT] Work In Progress" {
+		t.Errorf("Bad draft title, got %v", post.Title())
+	}
+	if next := gw.site.Posts["02-test"].Next(); next != post {
+		t.Errorf("Draft should be the next post, got %v", next)
+	}
+	if _, err := fs.Stat("build/2012-09-10/draft/index.html"); err != nil {
+		t.Errorf("Draft post should be rendered: %v", err)
+	}
+}
+
+const FUTURE_POST_META = `
+date: 2999-01-01
+slug: future
+title: From The Future`
+
+// Ensures future-dated posts are skipped unless requested.
+func TestFuturePosts(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/02-future/meta.yaml", FUTURE_POST_META)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, ok := gw.site.Posts["02-future"]; ok {
+		t.Errorf("Future post should not be parsed")
+	}
+	if _, err := fs.Stat("build/2999-01-01/future/index.html"); err == nil {
+		t.Errorf("Future post should not be rendered")
+	}
+	if s := gw.NextScheduled().Format("2006-01-02"); s != "2999-01-01" {
+		t.Errorf("Bad next scheduled time, got %v", s)
+	}
+
+	gw.args.future = true
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := fs.Stat("build/2999-01-01/future/index.html"); err != nil {
+		t.Errorf("Future post should be rendered: %v", err)
+	}
+	if !gw.NextScheduled().IsZero() {
+		t.Errorf("Nothing should be scheduled, got %v", gw.NextScheduled())
+	}
+}
+
+// Ensures unchanged posts and pages are not re-rendered between builds.
+func TestIncrementalBuild(t *testing.T) {
+	var (
+		post1 = "build/2012-09-07/hello-world/index.html"
+		post2 = "build/2012-09-09/hello-again/index.html"
+		index = "build/index.html"
+	)
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/templates/tags.tmpl", TAGS_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/01-test/img.png", "")
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD)
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	WriteFile(fs, "src/index.tmpl", INDEX_TMPL)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if _, err := fs.Stat(".ghostwriter/" + MANIFEST_NAME); err != nil {
+		t.Fatalf("Manifest should be written next to the build: %v", err)
+	}
+	if _, err := fs.Stat("build/" + MANIFEST_NAME); err == nil {
+		t.Errorf("Manifest should not be published")
+	}
+
+	// Outputs of unchanged inputs are left alone.
+	WriteFile(fs, post1, "stale")
+	WriteFile(fs, post2, "stale")
+	WriteFile(fs, index, "stale")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, post1, "stale")
+	LooseCompareFile(t, fs, post2, "stale")
+	LooseCompareFile(t, fs, index, "stale")
+
+	// Changing a post body re-renders the post and listings which include it.
+	// Other post pages may show the body too, so they are also rendered.
+	WriteFile(fs, "src/posts/02-test/body.md", POST_2_MD+"\nMore.")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _ := ReadFile(fs, post2); !strings.Contains(data, "More.") {
+		t.Errorf("Changed post should be rendered, got %v", data)
+	}
+	if data, _ := ReadFile(fs, post1); data == "stale" {
+		t.Errorf("Other posts should be rendered after a body changes")
+	}
+	if data, _ := ReadFile(fs, index); data == "stale" {
+		t.Errorf("Index should be rendered after a post changes")
+	}
+
+	// Changing a post without changing its body leaves other posts alone.
+	WriteFile(fs, post2, "stale")
+	WriteFile(fs, "src/posts/01-test/img.png", "changed")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, post2, "stale")
+	LooseCompareFile(t, fs, "build/2012-09-07/hello-world/img.png", "changed")
+
+	// Deleted outputs are regenerated.
+	fs.Remove(post1)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, post1, POST_1_HTML)
+
+	// Full builds ignore the manifest.
+	WriteFile(fs, post1, "stale")
+	gw.args.full = true
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	LooseCompareFile(t, fs, post1, POST_1_HTML)
+}
+
+// Ensures post pages are rendered again when the body of a neighbor changes.
+func TestIncrementalNeighbors(t *testing.T) {
+	var post1 = "build/2012-09-07/hello-world/index.html"
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", `{{define "body"}}{{with .Post.Next}}{{.Snippet}}{{end}}{{end}}`)
+	WriteFile(fs, "src/posts/01-test/body.md", "First")
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/02-test/body.md", "Old snippet.<!--BREAK-->Rest.")
+	WriteFile(fs, "src/posts/02-test/meta.yaml", POST_2_META)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _ := ReadFile(fs, post1); !strings.Contains(data, "Old snippet.") {
+		t.Fatalf("Expected the next post's snippet in:\n%v", data)
+	}
+	WriteFile(fs, "src/posts/02-test/body.md", "New snippet.<!--BREAK-->Rest.")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _ := ReadFile(fs, post1); !strings.Contains(data, "New snippet.") {
+		t.Errorf("Expected the changed snippet in:\n%v", data)
+	}
+}
+
+const PARALLEL_POST_META = `
+date: 2015-01-%02d
+slug: post-%02d
+title: Post %v`
+
+// Ensures posts render in parallel and errors are reported deterministically.
+func TestParallelRender(t *testing.T) {
+	gw, fs := Setup()
+	gw.args.jobs = 8
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/static/a.css", "a")
+	WriteFile(fs, "src/static/b.css", "b")
+	for i := 1; i <= 20; i++ {
+		dir := fmt.Sprintf("src/posts/%02d-test", i)
+		WriteFile(fs, dir+"/meta.yaml", fmt.Sprintf(PARALLEL_POST_META, i, i, i))
+		WriteFile(fs, dir+"/body.md", fmt.Sprintf("Body of {{.Title}} with [link]({{link \"%02d-test\"}})", i))
+		WriteFile(fs, dir+"/img.png", "")
+	}
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		dst := fmt.Sprintf("build/2015-01-%02d/post-%02d/index.html", i, i)
+		data, err := ReadFile(fs, dst)
+		if err != nil {
+			t.Fatalf("Post should be rendered: %v", err)
+		}
+		if !strings.Contains(data, fmt.Sprintf("/2015-01-%02d/post-%02d", i, i)) {
+			t.Errorf("Bad link in %v, got %v", dst, data)
+		}
+		if _, err := fs.Stat(fmt.Sprintf("build/2015-01-%02d/post-%02d/img.png", i, i)); err != nil {
+			t.Errorf("Post content should be copied: %v", err)
+		}
+	}
+	LooseCompareFile(t, fs, "build/static/a.css", "a")
+	LooseCompareFile(t, fs, "build/static/b.css", "b")
+
+	WriteFile(fs, "src/posts/05-test/body.md", "{{")
+	WriteFile(fs, "src/posts/15-test/body.md", "{{end}}")
+	var first string
+	for i := 0; i < 5; i++ {
+		err := gw.Process()
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if first == "" {
+			first = err.Error()
+		} else if err.Error() != first {
+			t.Errorf("Error should be deterministic, got %v then %v", first, err)
+		}
+	}
+	if !strings.Contains(first, "unclosed action") {
+		t.Errorf("Error should come from the first failing post, got %v", first)
+	}
+}
+
+// Ensures post pages show the bodies of other posts rendered in parallel.
+func TestParallelBodies(t *testing.T) {
+	var expected string
+	gw, fs := Setup()
+	gw.args.jobs = 8
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", `{{define "body"}}{{range .Site.Posts}}[{{.Body}}]{{end}}{{end}}`)
+	for i := 1; i <= 20; i++ {
+		dir := fmt.Sprintf("src/posts/%02d-test", i)
+		WriteFile(fs, dir+"/meta.yaml", fmt.Sprintf(PARALLEL_POST_META, i, i, i))
+		WriteFile(fs, dir+"/body.md", fmt.Sprintf("Body %v", i))
+		expected += fmt.Sprintf("[<p>Body %v</p>\n]", i)
+	}
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for i := 1; i <= 20; i++ {
+		dst := fmt.Sprintf("build/2015-01-%02d/post-%02d/index.html", i, i)
+		if data, _ := ReadFile(fs, dst); !strings.Contains(data, expected) {
+			t.Errorf("Expected %q in %v:\n%v", expected, dst, data)
+		}
+	}
+}
+
+const RENAMED_POST_1_META = `
+date: 2012-09-07
+slug: goodbye-world
+title: Goodbye World!`
+
+// Ensures files which are no longer produced are removed from the build.
+func TestRemoveStale(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META+"\nkeep:\n  - CNAME\n  - /archive/*.zip")
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/01-test/img.png", "")
+	WriteFile(fs, "src/static/a.css", "a")
+	WriteFile(fs, "src/static/b.css", "b")
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	WriteFile(fs, "build/CNAME", "www.example.com")
+	WriteFile(fs, "build/.git/config", "")
+	WriteFile(fs, "build/archive/old.zip", "")
+	WriteFile(fs, "build/archive/old.txt", "")
+	WriteFile(fs, "src/posts/01-test/meta.yaml", RENAMED_POST_1_META)
+	fs.Remove("src/static/b.css")
+
+	gw.args.dryRun = true
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	expected := []string{
+		"2012-09-07/hello-world/img.png",
+		"2012-09-07/hello-world/index.html",
+		"archive/old.txt",
+		"static/b.css",
+	}
+	if strings.Join(gw.stale, ",") != strings.Join(expected, ",") {
+		t.Errorf("Bad stale files, got %v, expected %v", gw.stale, expected)
+	}
+	if _, err := fs.Stat("build/static/b.css"); err != nil {
+		t.Errorf("Dry run should not remove files: %v", err)
+	}
+
+	gw.args.dryRun = false
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	for _, p := range append(expected, "2012-09-07/hello-world") {
+		if _, err := fs.Stat(path.Join("build", p)); err == nil {
+			t.Errorf("Stale path %v should be removed", p)
+		}
+	}
+	for _, p := range []string{
+		"CNAME",
+		".git/config",
+		"archive/old.zip",
+		"static/a.css",
+		"2012-09-07/goodbye-world/index.html",
+		"2012-09-07/goodbye-world/img.png",
+	} {
+		if _, err := fs.Stat(path.Join("build", p)); err != nil {
+			t.Errorf("Path %v should be kept: %v", p, err)
+		}
+	}
+}
+
+// Ensures HTML pages load the live reload script and rebuilds are streamed.
+func TestLiveReload(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "build/index.html", "<html><body>Hi</body></html>")
+	handler := &Handler{gw: gw}
+	w := httptest.NewRecorder()
+	handler.HandleRequest(w, httptest.NewRequest("GET", "/index.html", nil))
+	if strings.Contains(w.Body.String(), LIVE_RELOAD_SCRIPT_PATH) {
+		t.Errorf("Script should not be injected without a reloader")
+	}
+
+	handler.reloader = NewReloader()
+	w = httptest.NewRecorder()
+	handler.HandleRequest(w, httptest.NewRequest("GET", "/", nil))
+	expected := "<html><body>Hi<script src=\"" + LIVE_RELOAD_SCRIPT_PATH + "\"></script>\n</body></html>"
+	if w.Body.String() != expected {
+		t.Errorf("Bad injected page, got %v", w.Body.String())
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleLiveReload))
+	defer server.Close()
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	readEvent := func() (name string) {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading event: %v", err)
+			}
+			if line == "\n" && name != "" {
+				return
+			}
+			if strings.HasPrefix(line, "event: ") {
+				name = strings.TrimSpace(line[7:])
+			}
+		}
+	}
+	if name := readEvent(); name != "hello" {
+		t.Errorf("Expected hello event, got %v", name)
+	}
+	handler.reloader.Broadcast(reloadEventFor([]string{"src/static/site.css"}))
+	if name := readEvent(); name != "css" {
+		t.Errorf("Expected css event, got %v", name)
+	}
+	handler.reloader.Broadcast(reloadEventFor([]string{"src/static/site.css", "src/index.tmpl"}))
+	if name := readEvent(); name != "reload" {
+		t.Errorf("Expected reload event, got %v", name)
+	}
+}
+
+// Ensures failing builds are described in place of pages until fixed.
+func TestErrorOverlay(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/posts/01-test/body.md", "Fine.\n{{.Missing <b>}}")
+	WriteFile(fs, "src/index.tmpl", INDEX_TMPL)
+	if err := gw.Process(); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	status := gw.Status()
+	if status.Ok || status.Error == nil {
+		t.Fatalf("Status should record the failure, got %v", status)
+	}
+	if status.Error.File != "src/posts/01-test/body.md" {
+		t.Errorf("Bad file, got %v", status.Error.File)
+	}
+	if status.Error.Template != "body" || status.Error.Line != 2 {
+		t.Errorf("Bad location, got %v:%v", status.Error.Template, status.Error.Line)
+	}
+	handler := &Handler{gw: gw, reloader: NewReloader()}
+	w := httptest.NewRecorder()
+	handler.HandleRequest(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Bad status code, got %v", w.Code)
+	}
+	for _, s := range []string{
+		"src/posts/01-test/body.md",
+		"body line 2",
+		"unexpected &#34;&lt;&#34;",
+		LIVE_RELOAD_SCRIPT_PATH,
+	} {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("Overlay should contain %v, got %v", s, w.Body.String())
+		}
+	}
+
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if status = gw.Status(); !status.Ok || status.Error != nil {
+		t.Errorf("Status should be cleared, got %v", status)
+	}
+	w = httptest.NewRecorder()
+	handler.HandleRequest(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "Build failed") {
+		t.Errorf("Page should be served after a successful build, got %v", w.Body.String())
+	}
+}
+
+// Ensures the outcome of the last build is served as JSON.
+func TestStatusEndpoint(t *testing.T) {
+	var status map[string]interface{}
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/post.tmpl", "{{.Post.Title")
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	if err := gw.Process(); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	handler := &Handler{gw: gw}
+	w := httptest.NewRecorder()
+	handler.HandleStatus(w, httptest.NewRequest("GET", STATUS_PATH, nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid status %v: %v", w.Body.String(), err)
+	}
+	if status["ok"] != false {
+		t.Errorf("Status should not be ok, got %v", status)
+	}
+	berr, _ := status["error"].(map[string]interface{})
+	if berr["file"] != "src/templates/post.tmpl" || berr["line"] != 1.0 {
+		t.Errorf("Bad error status, got %v", berr)
+	}
+
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	w = httptest.NewRecorder()
+	handler.HandleStatus(w, httptest.NewRequest("GET", STATUS_PATH, nil))
+	status = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Invalid status %v: %v", w.Body.String(), err)
+	}
+	if _, ok := status["error"]; status["ok"] != true || ok {
+		t.Errorf("Status should be ok, got %v", status)
+	}
+}
+
+// Ensures the server handles missing pages, directories and clean URLs.
+func TestServerRouting(t *testing.T) {
+	gw, fs := Setup()
+	WriteFile(fs, "src/config.yaml", SITE_META)
+	WriteFile(fs, "src/templates/root.tmpl", SITE_TMPL)
+	WriteFile(fs, "src/templates/post.tmpl", POST_TMPL)
+	WriteFile(fs, "src/posts/01-test/body.md", POST_1_MD)
+	WriteFile(fs, "src/posts/01-test/meta.yaml", POST_1_META)
+	WriteFile(fs, "src/404.tmpl", `{{define "body"}}Nothing here.{{end}}`)
+	WriteFile(fs, "src/about.tmpl", `{{define "body"}}About.{{end}}`)
+	if err := gw.Process(); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _ := ReadFile(fs, "build/sitemap.xml"); strings.Contains(data, "404") {
+		t.Errorf("Sitemap should not include the 404 page, got %v", data)
+	}
+	handler := &Handler{gw: gw}
+	get := func(p string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.HandleRequest(w, httptest.NewRequest("GET", p, nil))
+		return w
+	}
+	expect := func(p string, code int, content string) {
+		w := get(p)
+		if w.Code != code {
+			t.Errorf("Bad status for %v, got %v expected %v", p, w.Code, code)
+		}
+		if !strings.Contains(w.Body.String(), content) && w.Header().Get("Location") != content {
+			t.Errorf("Bad response for %v, got %v expected %v", p, w.Body.String(), content)
+		}
+	}
+	expect("/missing", http.StatusNotFound, "Nothing here.")
+	expect("/about.html", http.StatusOK, "About.")
+	expect("/about", http.StatusNotFound, "Nothing here.")
+	expect("/2012-09-07/hello-world", http.StatusMovedPermanently, "/2012-09-07/hello-world/")
+	expect("/2012-09-07/hello-world/", http.StatusOK, "Hello World!")
+
+	handler.config.CleanURLs = true
+	expect("/about", http.StatusOK, "About.")
+	expect("/about.html", http.StatusMovedPermanently, "/about")
+	expect("/index.html?q=1", http.StatusMovedPermanently, "/?q=1")
+
+	fs.Remove("build/404.html")
+	expect("/missing", http.StatusNotFound, "404 page not found")
+}
+
+// Ensures the server compresses responses and sends caching headers.
+func TestServerCaching(t *testing.T) {
+	var (
+		js      = strings.Repeat("console.log('hello');\n", 20)
+		sidecar []byte
+		err     error
+	)
+	gw, fs := Setup()
+	if sidecar, err = gzipBytes([]byte("precompressed")); err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	WriteFile(fs, "build/static/app.js", js)
+	WriteFile(fs, "build/static/site.css", "body {}")
+	WriteFileBytes(fs, "build/static/site.css.gz", sidecar)
+	WriteFile(fs, "build/static/img.png", "png")
+	handler := &Handler{gw: gw}
+	handler.config.Cache = []CacheMeta{
+		CacheMeta{Path: "*.css", Control: "public, max-age=60"},
+		CacheMeta{Path: "/static/*", Control: "public, max-age=3600"},
+	}
+	get := func(p string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", p, nil)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		handler.HandleRequest(w, r)
+		return w
+	}
+
+	w := get("/static/app.js", "Accept-Encoding", "deflate, gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Response should be gzipped, got %v", w.Header())
+	}
+	z, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Error: %v", err)
+	}
+	if data, _ := ioutil.ReadAll(z); string(data) != js {
+		t.Errorf("Bad decompressed body, got %v", string(data))
+	}
+	if w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Bad Vary header, got %v", w.Header().Get("Vary"))
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("Bad Cache-Control, got %v", w.Header().Get("Cache-Control"))
+	}
+	gzipETag := w.Header().Get("ETag")
+
+	w = get("/static/app.js")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != js {
+		t.Errorf("Response should not be gzipped, got %v", w.Header())
+	}
+	if etag := w.Header().Get("ETag"); etag == "" || etag == gzipETag {
+		t.Errorf("Encodings should have distinct ETags, got %v and %v", etag, gzipETag)
+	}
+	if w = get("/static/app.js", "Accept-Encoding", "gzip;q=0"); w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Response should not be gzipped when refused")
+	}
+
+	w = get("/static/site.css", "Accept-Encoding", "gzip")
+	if w.Body.String() != string(sidecar) || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Sidecar should be served, got %v", w.Header())
+	}
+	if ctype := w.Header().Get("Content-Type"); !strings.HasPrefix(ctype, "text/css") {
+		t.Errorf("Bad Content-Type for sidecar, got %v", ctype)
+	}
+	if w.Header().Get("Cache-Control") != "public, max-age=60" {
+		t.Errorf("Bad Cache-Control, got %v", w.Header().Get("Cache-Control"))
+	}
+
+	w = get("/static/img.png", "Accept-Encoding", "gzip")
+	etag := w.Header().Get("ETag")
+	if w.Header().Get("Content-Encoding") != "" || !strings.HasPrefix(etag, "\"") {
+		t.Errorf("Bad headers for image, got %v", w.Header())
+	}
+	if w = get("/static/img.png", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected not modified, got %v", w.Code)
+	}
+}
+
+// Returns the paths of the JPEGs to benchmark against.  Set
+// GHOSTWRITER_BENCH_IMAGES to a directory of photos to use real files,
+// otherwise a few large JPEGs are generated in memory.
+func benchmarkImages(b *testing.B) (fs fauxfile.Filesystem, paths []string) {
+	if dir := os.Getenv("GHOSTWRITER_BENCH_IMAGES"); dir != "" {
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			b.Fatalf("Error: %v", err)
+		}
+		for _, info := range names {
+			if isJPEG(info.Name()) {
+				paths = append(paths, path.Join(dir, info.Name()))
+			}
+		}
+		return &fauxfile.RealFilesystem{}, paths
+	}
+	mock := fauxfile.NewMockFilesystem()
+	img := image.NewRGBA(image.Rect(0, 0, 4000, 3000))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7)
+	}
+	for i := 0; i < 4; i++ {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			b.Fatalf("Error: %v", err)
+		}
+		p := fmt.Sprintf("/images/photo%v.jpg", i)
+		WriteFileBytes(mock, p, buf.Bytes())
+		paths = append(paths, p)
+	}
+	return mock, paths
+}
+
+// Compares reading image sizes by decoding, by probing headers and from
+// the image cache.
+func BenchmarkImageData(b *testing.B) {
+	fs, paths := benchmarkImages(b)
+	if len(paths) == 0 {
+		b.Skip("No JPEGs to benchmark")
+	}
+	b.Run("Decode", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range paths {
+				f, err := fs.Open(p)
+				if err != nil {
+					b.Fatalf("Error: %v", err)
+				}
+				if _, _, err = image.Decode(f); err != nil {
+					b.Fatalf("Error: %v", err)
+				}
+				f.Close()
+			}
+		}
+	})
+	b.Run("Probe", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, p := range paths {
+				if _, err := NewImageData(fs, nil, p, p, ""); err != nil {
+					b.Fatalf("Error: %v", err)
+				}
+			}
+		}
+	})
+	b.Run("Cached", func(b *testing.B) {
+		cache := NewImageCache()
+		for i := 0; i < b.N; i++ {
+			for _, p := range paths {
+				if _, err := NewImageData(fs, cache, p, p, ""); err != nil {
+					b.Fatalf("Error: %v", err)
+				}
+			}
+		}
+	})
+}
@@ -3,6 +3,7 @@ module github.com/kurrik/ghostwriter
 go 1.13
 
 require (
+	github.com/alecthomas/chroma v0.10.0
 	github.com/howeyc/fsnotify v0.9.0
 	github.com/kurrik/fauxfile v0.0.0-20150303053957-b2e63e6e501c
 	github.com/kurrik/tmpl v0.0.0-20191122055449-d7284f685991
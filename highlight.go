@@ -0,0 +1,165 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/alecthomas/chroma"
+	"github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"gopkg.in/russross/blackfriday.v2"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Theme used for the highlighting stylesheet if none is configured.
+const DEFAULT_HIGHLIGHT_THEME = "github"
+
+// Options for a fenced code block, parsed from its info string.  The info
+// string is the language, optionally followed by ranges of lines to
+// highlight and "linenos" or "nolinenos", as in "go{3,5-7}" or
+// "{go 3,5-7 linenos}".  Blackfriday ends info strings which are not wrapped
+// in braces at the first space, so options in "go {3,5-7}" never reach us.
+type codeInfo struct {
+	lang        string
+	lines       [][2]int
+	lineNumbers *bool
+}
+
+// Parses the info string of a fenced code block.  Unrecognized options are
+// ignored.
+func parseCodeInfo(info string) (c codeInfo) {
+	fields := strings.Fields(strings.NewReplacer("{", " ", "}", " ").Replace(info))
+	if len(fields) == 0 {
+		return
+	}
+	c.lang = fields[0]
+	for _, field := range fields[1:] {
+		switch field {
+		case "linenos":
+			on := true
+			c.lineNumbers = &on
+		case "nolinenos":
+			off := false
+			c.lineNumbers = &off
+		default:
+			if lines, ok := parseLineRanges(strings.TrimPrefix(field, "hl_lines=")); ok {
+				c.lines = append(c.lines, lines...)
+			}
+		}
+	}
+	return
+}
+
+// Parses comma separated line numbers and ranges such as "3,5-7".
+func parseLineRanges(s string) (ranges [][2]int, ok bool) {
+	for _, part := range strings.Split(s, ",") {
+		var (
+			bounds = strings.SplitN(part, "-", 2)
+			r      [2]int
+			err    error
+		)
+		if r[0], err = strconv.Atoi(bounds[0]); err != nil || r[0] < 1 {
+			return nil, false
+		}
+		r[1] = r[0]
+		if len(bounds) == 2 {
+			if r[1], err = strconv.Atoi(bounds[1]); err != nil || r[1] < r[0] {
+				return nil, false
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, true
+}
+
+// Returns the HTML formatter for code blocks.  Highlighting is done with CSS
+// classes, so pages need the stylesheet written by WriteStyles.  Line numbers
+// go in a separate table column, so that they are not copied with the code.
+func highlightFormatter(lineNumbers bool, lines [][2]int) *html.Formatter {
+	return html.New(
+		html.WithClasses(true),
+		html.WithLineNumbers(lineNumbers),
+		html.LineNumbersInTable(true),
+		html.HighlightLines(lines))
+}
+
+// Renders code as highlighted HTML.  Code in languages which are not
+// recognized is escaped as plain text.
+func highlightCode(w io.Writer, meta *HighlightMeta, info string, code string) (err error) {
+	var (
+		c           = parseCodeInfo(info)
+		lineNumbers = meta.LineNumbers
+		lexer       chroma.Lexer
+		iterator    chroma.Iterator
+	)
+	if c.lineNumbers != nil {
+		lineNumbers = *c.lineNumbers
+	}
+	if lexer = lexers.Get(c.lang); lexer == nil {
+		lexer = lexers.Fallback
+	}
+	if iterator, err = chroma.Coalesce(lexer).Tokenise(nil, code); err != nil {
+		return
+	}
+	return highlightFormatter(lineNumbers, c.lines).Format(w, styles.Fallback, iterator)
+}
+
+// Renders Markdown like blackfriday's HTML renderer, but highlights fenced
+// code blocks which declare a language.
+type highlightRenderer struct {
+	*blackfriday.HTMLRenderer
+	meta *HighlightMeta
+}
+
+func (r *highlightRenderer) RenderNode(w io.Writer, node *blackfriday.Node, entering bool) blackfriday.WalkStatus {
+	if node.Type != blackfriday.CodeBlock || !node.IsFenced || len(node.Info) == 0 {
+		return r.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	var out bytes.Buffer
+	if err := highlightCode(&out, r.meta, string(node.Info), string(node.Literal)); err != nil {
+		// Chroma only fails on broken lexers, the code is still worth showing.
+		return r.HTMLRenderer.RenderNode(w, node, entering)
+	}
+	out.WriteString("\n")
+	w.Write(out.Bytes())
+	return blackfriday.GoToNext
+}
+
+// Writes the stylesheet for highlighted code to w.  The theme is taken from
+// the -theme flag, then the site config, then DEFAULT_HIGHLIGHT_THEME.
+func WriteStyles(gw *GhostWriter, w io.Writer) (err error) {
+	var (
+		theme = gw.args.theme
+		style *chroma.Style
+		ok    bool
+	)
+	if theme == "" {
+		if err = gw.parseSiteMeta(); err != nil {
+			return
+		}
+		theme = gw.site.meta.Highlight.Theme
+	}
+	if theme == "" {
+		theme = DEFAULT_HIGHLIGHT_THEME
+	}
+	if style, ok = styles.Registry[theme]; !ok {
+		return fmt.Errorf("Unknown theme %q, expected one of: %v", theme, strings.Join(styles.Names(), ", "))
+	}
+	return highlightFormatter(true, nil).WriteCSS(w, style)
+}
@@ -15,13 +15,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"github.com/kurrik/fauxfile"
 	"image"
 	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"mime"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
 )
 
 type ImageData struct {
@@ -29,33 +37,57 @@ type ImageData struct {
 	Height    int
 	Path      string
 	Permalink string
+	Exif      *Exif // Nil unless the image is a JPEG with EXIF metadata.
 }
 
-func NewImageData(fs fauxfile.Filesystem, srcPath string, dstPath string, siteRoot string) (data ImageData, err error) {
-	var (
-		img  image.Image
-		file fauxfile.File
-	)
-	if file, err = fs.Open(srcPath); err != nil {
-		return
-	}
-	defer file.Close()
-	if img, _, err = image.Decode(file); err != nil {
+func NewImageData(fs fauxfile.Filesystem, cache *ImageCache, srcPath string, dstPath string, siteRoot string) (data ImageData, err error) {
+	var probe *ImageProbe
+	if probe, err = cache.Probe(fs, srcPath); err != nil {
 		return
 	}
 	data = ImageData{
-		Width:     img.Bounds().Dx(),
-		Height:    img.Bounds().Dy(),
+		Width:     probe.Width,
+		Height:    probe.Height,
 		Path:      dstPath,
 		Permalink: fmt.Sprintf("%v%v", siteRoot, dstPath),
+		Exif:      probe.Exif,
+	}
+	if probe.Exif.Transposed() {
+		data.Width, data.Height = data.Height, data.Width
 	}
 	return
 }
 
+// Default JPEG quality of generated variants.
+const DEFAULT_VARIANT_QUALITY = 85
+
 type Image struct {
-	meta     ImageMeta
-	data     ImageData
-	variants map[string]ImageData
+	meta      ImageMeta
+	data      ImageData
+	variants  map[string]ImageData
+	srcPath   string
+	generated []imageVariant
+}
+
+// A variant which is generated from the source image at render time.
+type imageVariant struct {
+	key  string
+	meta ImageVariantMeta
+	name string
+	data ImageData
+}
+
+// Returns the file name of the variant key of the image at src.  GIF sources
+// produce PNG variants.
+func variantName(src string, key string) string {
+	var (
+		ext  = filepath.Ext(src)
+		base = strings.TrimSuffix(filepath.Base(src), ext)
+	)
+	if strings.ToLower(ext) == ".gif" {
+		ext = ".png"
+	}
+	return fmt.Sprintf("%v.%v%v", base, key, ext)
 }
 
 func NewImage(gw *GhostWriter, meta ImageMeta, postSrcDir string, postDstDir string, siteRoot string) (out *Image, err error) {
@@ -66,22 +98,128 @@ func NewImage(gw *GhostWriter, meta ImageMeta, postSrcDir string, postDstDir str
 	var (
 		srcPath string = filepath.Join(postSrcDir, meta.Src)
 		dstPath string = filepath.Join(postDstDir, meta.Src)
+		keys    []string
 	)
-	if out.data, err = NewImageData(gw.fs, srcPath, dstPath, siteRoot); err != nil {
+	out.srcPath = srcPath
+	if out.data, err = NewImageData(gw.fs, gw.images, srcPath, dstPath, siteRoot); err != nil {
 		return
 	}
-	for key, variantMeta := range meta.Variants {
+	for key := range meta.Variants {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		variantMeta := meta.Variants[key]
 		if variantMeta.Src != nil {
 			srcPath = filepath.Join(postSrcDir, *variantMeta.Src)
 			dstPath = filepath.Join(postDstDir, *variantMeta.Src)
-			if out.variants[key], err = NewImageData(gw.fs, srcPath, dstPath, siteRoot); err != nil {
+			if out.variants[key], err = NewImageData(gw.fs, gw.images, srcPath, dstPath, siteRoot); err != nil {
+				return
+			}
+			continue
+		}
+		v := imageVariant{
+			key:  key,
+			meta: variantMeta,
+			name: variantName(meta.Src, key),
+		}
+		if v.meta.Quality == 0 {
+			v.meta.Quality = DEFAULT_VARIANT_QUALITY
+		}
+		if v.meta.Quality < 1 || v.meta.Quality > 100 {
+			err = fmt.Errorf("Variant %v of %v has invalid quality %v", key, meta.Src, v.meta.Quality)
+			return
+		}
+		if v.data.Width, v.data.Height, err = variantSize(out.data.Width, out.data.Height, variantMeta.Width, variantMeta.Height, variantMeta.Fit); err != nil {
+			err = fmt.Errorf("Variant %v of %v: %v", key, meta.Src, err)
+			return
+		}
+		v.data.Path = filepath.Join(postDstDir, v.name)
+		v.data.Permalink = fmt.Sprintf("%v%v", siteRoot, v.data.Path)
+		out.variants[key] = v.data
+		out.generated = append(out.generated, v)
+	}
+	return
+}
+
+// Writes generated variants of the image into the output directory of the
+// post at postpath, skipping those whose source and settings are unchanged
+// since the last build.  Returns the paths of the variant files.
+func (i *Image) renderVariants(gw *GhostWriter, postpath string) (files []string, err error) {
+	var (
+		img    image.Image
+		source string
+	)
+	if len(i.generated) == 0 {
+		return
+	}
+	h := sha256.New()
+	if err = gw.digestFile(h, i.srcPath); err != nil {
+		return
+	}
+	source = digestString(h)
+	for _, v := range i.generated {
+		var (
+			dst  = filepath.Join(gw.args.dst, postpath, v.name)
+			key  = fmt.Sprintf("image:%v", path.Join(postpath, v.name))
+			hash = digestListing(source, v.data.Width, v.data.Height, v.meta.Fit, v.meta.Quality)
+		)
+		files = append(files, dst)
+		if gw.cached(key, hash) != nil {
+			continue
+		}
+		if img == nil {
+			if img, err = gw.decodeImage(i.srcPath); err != nil {
 				return
 			}
+			if i.data.Exif != nil {
+				img = orientImage(img, i.data.Exif.Orientation)
+			}
+		}
+		if err = gw.writeImage(dst, fitImage(img, v.data.Width, v.data.Height, v.meta.Fit), v.meta.Quality); err != nil {
+			return
 		}
+		gw.record(key, hash, []string{dst})
 	}
 	return
 }
 
+// Decodes the image at src.
+func (gw *GhostWriter) decodeImage(src string) (img image.Image, err error) {
+	var file fauxfile.File
+	if file, err = gw.fs.Open(src); err != nil {
+		return
+	}
+	defer file.Close()
+	img, _, err = image.Decode(file)
+	return
+}
+
+// Encodes img to dst, as a JPEG if the extension of dst calls for one and as
+// a PNG otherwise.
+func (gw *GhostWriter) writeImage(dst string, img image.Image, quality int) (err error) {
+	var (
+		buf  bytes.Buffer
+		file fauxfile.File
+	)
+	switch strings.ToLower(filepath.Ext(dst)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return
+	}
+	if file, err = gw.fs.Create(dst); err != nil {
+		return
+	}
+	gw.track(dst)
+	defer file.Close()
+	_, err = file.Write(buf.Bytes())
+	return
+}
+
 func (i *Image) Data() ImageData {
 	return i.data
 }
@@ -107,3 +245,150 @@ func (i *Image) HasMetadata(key string) (exists bool) {
 func (i *Image) Metadata() map[string]string {
 	return i.meta.Metadata
 }
+
+// Content types of image formats which may appear in a <picture> element.
+var IMAGE_TYPES = map[string]string{
+	".avif": "image/avif",
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".webp": "image/webp",
+}
+
+// Content types offered by <picture> sources ahead of any others, best first.
+// Browsers use the first source they support.
+var PICTURE_TYPE_PREFERENCE = []string{"image/avif", "image/webp"}
+
+// Returns the position of ctype in PICTURE_TYPE_PREFERENCE, or its length for
+// types which are not listed.
+func pictureTypeRank(ctype string) int {
+	for i, t := range PICTURE_TYPE_PREFERENCE {
+		if t == ctype {
+			return i
+		}
+	}
+	return len(PICTURE_TYPE_PREFERENCE)
+}
+
+// Returns the content type of the image at p.
+func imageType(p string) string {
+	var ext = strings.ToLower(filepath.Ext(p))
+	if ctype, ok := IMAGE_TYPES[ext]; ok {
+		return ctype
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// Returns the image and those of its variants which are the same picture at
+// a different size, grouped by content type and ordered by width.  Variants
+// cropped to a different aspect ratio are left out, since browsers assume
+// every srcset candidate shows the same thing.
+func (i *Image) candidates() (out map[string][]ImageData) {
+	var (
+		keys   []string
+		aspect = float64(i.data.Width) / float64(i.data.Height)
+	)
+	out = map[string][]ImageData{}
+	out[imageType(i.data.Path)] = []ImageData{i.data}
+	for key := range i.variants {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := i.variants[key]
+		if v.Width == 0 || v.Height == 0 {
+			continue
+		}
+		if math.Abs(float64(v.Width)/float64(v.Height)-aspect) > 0.01*aspect {
+			continue
+		}
+		ctype := imageType(v.Path)
+		out[ctype] = append(out[ctype], v)
+	}
+	for ctype, list := range out {
+		sort.SliceStable(list, func(a, b int) bool {
+			return list[a].Width < list[b].Width
+		})
+		// Keep one candidate per width.
+		unique := list[:0]
+		for _, data := range list {
+			if len(unique) == 0 || unique[len(unique)-1].Width != data.Width {
+				unique = append(unique, data)
+			}
+		}
+		out[ctype] = unique
+	}
+	return
+}
+
+// Formats a srcset attribute value from the given candidates.
+func srcset(list []ImageData) string {
+	var parts = make([]string, len(list))
+	for j, data := range list {
+		parts[j] = fmt.Sprintf("%v %vw", data.Permalink, data.Width)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Returns the sizes attribute value to use with the image, which fills the
+// viewport up to its full width unless sizes is given.
+func (i *Image) sizes(sizes string) string {
+	if sizes != "" {
+		return sizes
+	}
+	return fmt.Sprintf("(max-width: %vpx) 100vw, %vpx", i.data.Width, i.data.Width)
+}
+
+// Renders an <img> element for the image, offering variants in the same
+// format through srcset.
+func (i *Image) imgTag(sizes string) string {
+	var (
+		b     bytes.Buffer
+		ctype = imageType(i.data.Path)
+		list  = i.candidates()[ctype]
+	)
+	fmt.Fprintf(&b, `<img src="%v"`, template.HTMLEscapeString(i.data.Permalink))
+	if len(list) > 1 {
+		fmt.Fprintf(&b, ` srcset="%v" sizes="%v"`,
+			template.HTMLEscapeString(srcset(list)),
+			template.HTMLEscapeString(i.sizes(sizes)))
+	}
+	fmt.Fprintf(&b, ` width="%v" height="%v" alt="%v" loading="lazy">`,
+		i.data.Width, i.data.Height, template.HTMLEscapeString(i.meta.Metadata["alt"]))
+	return b.String()
+}
+
+// Renders a <picture> element for the image, with a <source> for each
+// format among its variants other than that of the image itself.
+func (i *Image) pictureTag(sizes string) string {
+	var (
+		b          bytes.Buffer
+		ctype      = imageType(i.data.Path)
+		candidates = i.candidates()
+		types      []string
+	)
+	for t := range candidates {
+		if t != ctype {
+			types = append(types, t)
+		}
+	}
+	sort.Slice(types, func(a, b int) bool {
+		ra, rb := pictureTypeRank(types[a]), pictureTypeRank(types[b])
+		if ra != rb {
+			return ra < rb
+		}
+		return types[a] < types[b]
+	})
+	b.WriteString("<picture>")
+	for _, t := range types {
+		fmt.Fprintf(&b, `<source type="%v" srcset="%v" sizes="%v">`,
+			template.HTMLEscapeString(t),
+			template.HTMLEscapeString(srcset(candidates[t])),
+			template.HTMLEscapeString(i.sizes(sizes)))
+	}
+	b.WriteString(i.imgTag(sizes))
+	b.WriteString("</picture>")
+	return b.String()
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/kurrik/fauxfile"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Name of the image metadata cache, stored in the cache dir.
+const IMAGE_CACHE_NAME = ".ghostwriter-images.json"
+
+// The dimensions and EXIF metadata of an image file, as of the given size and
+// modification time.  Locations are never cached, HasGPS records whether the
+// EXIF has one so that it can be read again when needed.
+type ImageProbe struct {
+	Size    int64
+	ModTime int64
+	Width   int
+	Height  int
+	Exif    *Exif `json:",omitempty"`
+	HasGPS  bool  `json:",omitempty"`
+}
+
+// Caches image metadata between builds, so that unchanged images are not
+// read again.
+type ImageCache struct {
+	Entries map[string]*ImageProbe
+	used    map[string]bool
+	mu      sync.Mutex
+}
+
+// Creates an empty ImageCache.
+func NewImageCache() *ImageCache {
+	return &ImageCache{
+		Entries: map[string]*ImageProbe{},
+		used:    map[string]bool{},
+	}
+}
+
+// Returns the metadata of the image at path, reading only the image headers
+// and only if the file has changed since it was cached.  A nil cache reads
+// the file every time.
+func (c *ImageCache) Probe(fs fauxfile.Filesystem, path string) (probe *ImageProbe, err error) {
+	var (
+		info   os.FileInfo
+		file   fauxfile.File
+		config image.Config
+		cached *ImageProbe
+		ok     bool
+	)
+	if info, err = fs.Stat(path); err != nil {
+		return
+	}
+	if c != nil {
+		c.mu.Lock()
+		cached, ok = c.Entries[path]
+		c.used[path] = true
+		c.mu.Unlock()
+		if ok && cached.Size == info.Size() && cached.ModTime == info.ModTime().UnixNano() {
+			if !cached.HasGPS {
+				return cached, nil
+			}
+			if file, err = fs.Open(path); err != nil {
+				return
+			}
+			defer file.Close()
+			probe = &ImageProbe{}
+			*probe = *cached
+			probe.Exif = readExif(file)
+			return
+		}
+	}
+	if file, err = fs.Open(path); err != nil {
+		return
+	}
+	defer file.Close()
+	probe = &ImageProbe{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Exif:    readExif(file),
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if config, _, err = image.DecodeConfig(file); err != nil {
+		return
+	}
+	probe.Width = config.Width
+	probe.Height = config.Height
+	if c != nil {
+		cached = &ImageProbe{}
+		*cached = *probe
+		if probe.Exif != nil && probe.Exif.GPS != nil {
+			exif := *probe.Exif
+			exif.GPS = nil
+			cached.Exif = &exif
+			cached.HasGPS = true
+		}
+		c.mu.Lock()
+		c.Entries[path] = cached
+		c.mu.Unlock()
+	}
+	return
+}
+
+// Loads the image cache persisted by a previous build.  Returns an empty
+// cache if none exists, if it is unreadable or if a full build was requested.
+func (gw *GhostWriter) loadImageCache() (c *ImageCache) {
+	var (
+		src  = filepath.Join(gw.cacheDir(), IMAGE_CACHE_NAME)
+		data string
+		err  error
+	)
+	c = NewImageCache()
+	if gw.args.full {
+		return
+	}
+	if data, err = gw.readFile(src); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(data), c); err != nil {
+		gw.log.Printf("Ignoring invalid image cache %v: %v\n", src, err)
+		return NewImageCache()
+	}
+	if c.Entries == nil {
+		c.Entries = map[string]*ImageProbe{}
+	}
+	return
+}
+
+// Persists metadata for the images used by the current build into the cache
+// dir.
+func (gw *GhostWriter) saveImageCache() (err error) {
+	var (
+		dst  = filepath.Join(gw.cacheDir(), IMAGE_CACHE_NAME)
+		used = NewImageCache()
+		data []byte
+	)
+	gw.images.mu.Lock()
+	for p := range gw.images.used {
+		if probe, ok := gw.images.Entries[p]; ok {
+			used.Entries[p] = probe
+		}
+	}
+	gw.images.mu.Unlock()
+	if data, err = json.Marshal(used); err != nil {
+		return
+	}
+	if err = gw.fs.MkdirAll(gw.cacheDir(), 0755); err != nil {
+		return
+	}
+	return writeFile(gw, string(data), dst)
+}
@@ -0,0 +1,193 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Path of the Server-Sent Events stream which notifies browsers of rebuilds.
+const LIVE_RELOAD_PATH = "/_ghostwriter/livereload"
+
+// Path of the client script injected into HTML pages.
+const LIVE_RELOAD_SCRIPT_PATH = "/_ghostwriter/livereload.js"
+
+// Event streams are closed after this long so that they finish within the
+// server's write timeout.  Browsers reconnect automatically, sending the id
+// of the last event they saw so that no rebuild is missed.
+const LIVE_RELOAD_TIMEOUT = 5 * time.Second
+
+// Reloads the page on a "reload" event, and refreshes stylesheets in place on
+// a "css" event.
+const LIVE_RELOAD_SCRIPT = `(function() {
+  if (!window.EventSource) {
+    return;
+  }
+  var source = new EventSource("` + LIVE_RELOAD_PATH + `");
+  source.addEventListener("reload", function() {
+    window.location.reload();
+  });
+  source.addEventListener("css", function() {
+    var links = document.querySelectorAll('link[rel="stylesheet"]');
+    for (var i = 0; i < links.length; i++) {
+      var href = links[i].href.replace(/[?&]_gw=\d+$/, "");
+      var sep = href.indexOf("?") === -1 ? "?" : "&";
+      links[i].href = href + sep + "_gw=" + Date.now();
+    }
+  });
+})();
+`
+
+// A single notification sent to browsers.
+type reloadEvent struct {
+	Id   int
+	Name string
+}
+
+// Broadcasts rebuild notifications to connected browsers.
+type Reloader struct {
+	mu      sync.Mutex
+	last    reloadEvent
+	clients map[chan reloadEvent]bool
+}
+
+// Creates a new Reloader with no connected clients.
+func NewReloader() *Reloader {
+	return &Reloader{
+		clients: map[chan reloadEvent]bool{},
+	}
+}
+
+// Sends the named event to every connected browser.
+func (r *Reloader) Broadcast(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = reloadEvent{Id: r.last.Id + 1, Name: name}
+	for ch := range r.clients {
+		select {
+		case ch <- r.last:
+		default:
+			// Client is behind, it will catch up when it reconnects.
+		}
+	}
+}
+
+// Registers a client which has seen events up to lastId.  Returns a channel
+// of future events and the latest event, if the client missed it.
+func (r *Reloader) subscribe(lastId int) (ch chan reloadEvent, missed *reloadEvent, current int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ch = make(chan reloadEvent, 1)
+	r.clients[ch] = true
+	if lastId >= 0 && lastId < r.last.Id {
+		last := r.last
+		missed = &last
+	}
+	current = r.last.Id
+	return
+}
+
+// Removes a client registered with subscribe.
+func (r *Reloader) unsubscribe(ch chan reloadEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clients, ch)
+}
+
+// Returns the event to send after a build triggered by changes to paths.
+// Stylesheets can be swapped in place if nothing else changed.
+func reloadEventFor(paths []string) string {
+	if len(paths) == 0 {
+		return "reload"
+	}
+	for _, p := range paths {
+		if filepath.Ext(p) != ".css" {
+			return "reload"
+		}
+	}
+	return "css"
+}
+
+// Adds the live reload client script to an HTML document.
+func injectLiveReload(html []byte) []byte {
+	var (
+		script = []byte(fmt.Sprintf("<script src=\"%v\"></script>\n", LIVE_RELOAD_SCRIPT_PATH))
+		index  = bytes.LastIndex(bytes.ToLower(html), []byte("</body>"))
+		out    []byte
+	)
+	if index == -1 {
+		return append(html, script...)
+	}
+	out = make([]byte, 0, len(html)+len(script))
+	out = append(out, html[:index]...)
+	out = append(out, script...)
+	return append(out, html[index:]...)
+}
+
+// Serves the live reload client script.
+func (h *Handler) HandleLiveReloadScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(LIVE_RELOAD_SCRIPT))
+}
+
+// Streams rebuild notifications to a browser as Server-Sent Events.
+func (h *Handler) HandleLiveReload(w http.ResponseWriter, r *http.Request) {
+	var (
+		flusher http.Flusher
+		ok      bool
+		lastId  = -1
+		ch      chan reloadEvent
+		missed  *reloadEvent
+		current int
+		timeout = time.NewTimer(LIVE_RELOAD_TIMEOUT)
+	)
+	defer timeout.Stop()
+	if flusher, ok = w.(http.Flusher); !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if id, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		lastId = id
+	}
+	ch, missed, current = h.reloader.subscribe(lastId)
+	defer h.reloader.unsubscribe(ch)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: 500\n\n")
+	if missed != nil {
+		fmt.Fprintf(w, "id: %v\nevent: %v\ndata: \n\n", missed.Id, missed.Name)
+	} else {
+		fmt.Fprintf(w, "id: %v\nevent: hello\ndata: \n\n", current)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case evt := <-ch:
+			fmt.Fprintf(w, "id: %v\nevent: %v\ndata: \n\n", evt.Id, evt.Name)
+			flusher.Flush()
+		case <-timeout.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -19,35 +19,52 @@ import (
 	"fmt"
 	"github.com/kurrik/fauxfile"
 	"os"
+	"runtime"
 )
 
 // Arguments, passed to the main executable.
 type Args struct {
-	src          string
-	dst          string
-	addr         string
-	action       string
-	posts        string
-	templates    string
-	static       string
-	config       string
-	postTemplate string
-	tagsTemplate string
-	before       string
+	src             string
+	dst             string
+	cache           string
+	addr            string
+	action          string
+	posts           string
+	templates       string
+	static          string
+	config          string
+	postTemplate    string
+	tagsTemplate    string
+	archiveTemplate string
+	before          string
+	theme           string
+	drafts          bool
+	future          bool
+	full            bool
+	jobs            int
+	dryRun          bool
+	addrSet         bool
 }
 
 // Sensible defaults, for a sensible time.
 func DefaultArgs() *Args {
 	return &Args{
-		src:          "src",
-		dst:          "dst",
-		posts:        "posts",
-		templates:    "templates",
-		static:       "static",
-		config:       "config.yaml",
-		postTemplate: "post.tmpl",
-		tagsTemplate: "tags.tmpl",
-		before:       "",
+		src:             "src",
+		dst:             "dst",
+		cache:           "",
+		posts:           "posts",
+		templates:       "templates",
+		static:          "static",
+		config:          "config.yaml",
+		postTemplate:    "post.tmpl",
+		tagsTemplate:    "tags.tmpl",
+		archiveTemplate: "archive.tmpl",
+		before:          "",
+		drafts:          false,
+		future:          false,
+		full:            false,
+		jobs:            runtime.NumCPU(),
+		dryRun:          false,
 	}
 }
 
@@ -61,12 +78,29 @@ func main() {
 	a := DefaultArgs()
 	flag.StringVar(&a.src, "src", "src", "Path to src files.")
 	flag.StringVar(&a.dst, "dst", "dst", "Build output directory.")
+	flag.StringVar(&a.cache, "cache", "", "Directory for state kept between builds. Defaults to .ghostwriter next to dst.")
 	flag.StringVar(&a.addr, "address", ":8080", "Serve at this address. Eg: ':80'")
-	flag.StringVar(&a.action, "action", "process", "One of 'process', 'create' or 'serve'.")
+	flag.StringVar(&a.action, "action", "process", "One of 'process', 'create', 'serve' or 'styles'.")
 	flag.BoolVar(&watch, "watch", false, "Keep watching the source dir?")
 	flag.StringVar(&a.before, "before", "", "OS command to execute before build")
+	flag.StringVar(&a.theme, "theme", "", "Syntax highlighting theme for the 'styles' action.")
+	flag.BoolVar(&a.drafts, "drafts", false, "Include draft posts in the build?")
+	flag.BoolVar(&a.future, "future", false, "Include posts dated in the future?")
+	flag.BoolVar(&a.full, "full", false, "Re-render everything, ignoring the build manifest?")
+	flag.BoolVar(&a.dryRun, "dry-run", false, "List stale files in the build dir instead of removing them?")
+	flag.IntVar(&a.jobs, "jobs", runtime.NumCPU(), "Number of posts to render in parallel.")
 	flag.Parse()
+	flag.Visit(func(f *flag.Flag) {
+		// Only an explicit address overrides the server config.
+		if f.Name == "address" {
+			a.addrSet = true
+		}
+	})
 	gw = NewGhostWriter(&fauxfile.RealFilesystem{}, a)
+	if watch || a.action == "serve" {
+		// Reload open pages whenever the site is rebuilt.
+		gw.reloader = NewReloader()
+	}
 	if a.addr != "" {
 		go func() {
 			if err := Serve(gw); err != nil {
@@ -89,6 +123,9 @@ func main() {
 	case "process":
 		err = gw.Process()
 		break
+	case "styles":
+		err = WriteStyles(gw, os.Stdout)
+		break
 	}
 	if watch {
 		err = Watch(gw, a.src)
@@ -0,0 +1,348 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/kurrik/fauxfile"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Name of the build manifest, stored in the cache dir.  It holds rendered
+// post bodies, so it is kept out of the destination dir, which gets published.
+const MANIFEST_NAME = ".ghostwriter-manifest.json"
+
+// Name of the cache dir, which is placed next to the destination dir unless
+// another is given.
+const CACHE_DIR_NAME = ".ghostwriter"
+
+// Files larger than this are digested by size and modification time rather
+// than by content, to avoid reading large media on every build.
+const MANIFEST_CONTENT_LIMIT = 1 << 20
+
+// Records the result of rendering a single unit of the site, such as a post.
+type ManifestEntry struct {
+	Hash    string
+	Files   []string
+	Body    string      `json:",omitempty"`
+	Snippet string      `json:",omitempty"`
+	TOC     []*TOCEntry `json:",omitempty"`
+}
+
+// Records the inputs and outputs of a build, so that later builds can skip
+// re-rendering units whose inputs have not changed.
+type Manifest struct {
+	Entries map[string]*ManifestEntry
+	mu      sync.Mutex
+}
+
+// Creates an empty Manifest.
+func NewManifest() *Manifest {
+	return &Manifest{
+		Entries: map[string]*ManifestEntry{},
+	}
+}
+
+// Loads the manifest persisted by a previous build.  Returns an empty
+// manifest if none exists, if it is unreadable or if a full build was
+// requested.
+func (gw *GhostWriter) loadManifest() (m *Manifest) {
+	var (
+		src  = filepath.Join(gw.cacheDir(), MANIFEST_NAME)
+		data string
+		err  error
+	)
+	m = NewManifest()
+	if gw.args.full {
+		return
+	}
+	if data, err = gw.readFile(src); err != nil {
+		return
+	}
+	if err = json.Unmarshal([]byte(data), m); err != nil {
+		gw.log.Printf("Ignoring invalid manifest %v: %v\n", src, err)
+		return NewManifest()
+	}
+	if m.Entries == nil {
+		m.Entries = map[string]*ManifestEntry{}
+	}
+	return
+}
+
+// Returns the directory holding state which is kept between builds.
+func (gw *GhostWriter) cacheDir() string {
+	if gw.args.cache != "" {
+		return gw.args.cache
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(gw.args.dst)), CACHE_DIR_NAME)
+}
+
+// Persists the manifest for the current build into the cache dir.
+func (gw *GhostWriter) saveManifest() (err error) {
+	var (
+		dst  = filepath.Join(gw.cacheDir(), MANIFEST_NAME)
+		data []byte
+	)
+	if data, err = json.Marshal(gw.manifest); err != nil {
+		return
+	}
+	if err = gw.fs.MkdirAll(gw.cacheDir(), 0755); err != nil {
+		return
+	}
+	return writeFile(gw, string(data), dst)
+}
+
+// Returns the manifest entry recorded by the previous build for key, if its
+// hash matches and all of its output files still exist.  Matching entries are
+// carried forward into the manifest for the current build.
+func (gw *GhostWriter) cached(key string, hash string) (entry *ManifestEntry) {
+	var ok bool
+	gw.manifest.mu.Lock()
+	defer gw.manifest.mu.Unlock()
+	if entry, ok = gw.prevManifest.Entries[key]; !ok || entry.Hash != hash {
+		return nil
+	}
+	for _, f := range entry.Files {
+		if _, err := gw.fs.Stat(filepath.Join(gw.args.dst, f)); err != nil {
+			return nil
+		}
+	}
+	gw.log.Printf("Unchanged %v\n", key)
+	for _, f := range entry.Files {
+		gw.track(filepath.Join(gw.args.dst, f))
+	}
+	gw.manifest.Entries[key] = entry
+	return
+}
+
+// Records the files produced for key, given the hash of its inputs.
+// Paths should include the destination dir.
+func (gw *GhostWriter) record(key string, hash string, files []string) (entry *ManifestEntry) {
+	entry = &ManifestEntry{
+		Hash:  hash,
+		Files: make([]string, len(files)),
+	}
+	for i, f := range files {
+		if rel, err := filepath.Rel(gw.args.dst, f); err == nil {
+			f = rel
+		}
+		entry.Files[i] = filepath.ToSlash(f)
+	}
+	gw.manifest.mu.Lock()
+	defer gw.manifest.mu.Unlock()
+	gw.manifest.Entries[key] = entry
+	return
+}
+
+// Writes a digest of the file at path into h.
+func (gw *GhostWriter) digestFile(h hash.Hash, path string) (err error) {
+	var (
+		f    fauxfile.File
+		info os.FileInfo
+	)
+	if info, err = gw.fs.Stat(path); err != nil {
+		return
+	}
+	if info.Size() > MANIFEST_CONTENT_LIMIT {
+		fmt.Fprintf(h, "%v:%v:%v\n", path, info.Size(), info.ModTime().UnixNano())
+		return
+	}
+	if f, err = gw.fs.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(h, "%v:%v\n", path, info.Size())
+	_, err = io.Copy(h, f)
+	return
+}
+
+// Writes a digest of every file beneath the directory at path into h.
+func (gw *GhostWriter) digestDir(h hash.Hash, path string) (err error) {
+	var (
+		names []string
+		p     string
+	)
+	if names, err = gw.readDir(path); err != nil {
+		return
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		p = filepath.Join(path, n)
+		if gw.isDir(p) {
+			err = gw.digestDir(h, p)
+		} else {
+			err = gw.digestFile(h, p)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns the hex encoded sum of h.
+func digestString(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Computes a digest of the inputs shared by every rendered page: build flags
+// and directories, configuration, templates and the metadata of every post,
+// which determines the titles, paths and ordering used when rendering
+// neighboring posts.  The directories keep a cache dir shared by several
+// sites from passing one site's outputs off as another's.
+func (gw *GhostWriter) digestSite() (err error) {
+	var (
+		h   = sha256.New()
+		ids []string
+	)
+	fmt.Fprintf(h, "drafts:%v future:%v\n", gw.args.drafts, gw.args.future)
+	fmt.Fprintf(h, "src:%v dst:%v\n", gw.args.src, gw.args.dst)
+	if err = gw.digestFile(h, filepath.Join(gw.args.src, gw.args.config)); err != nil {
+		return
+	}
+	if dir := filepath.Join(gw.args.src, gw.args.templates); gw.isDir(dir) {
+		if err = gw.digestDir(h, dir); err != nil {
+			return
+		}
+	}
+	for id := range gw.site.Posts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		fmt.Fprintf(h, "post:%v\n", id)
+		if b, err := json.Marshal(gw.site.Posts[id].meta); err == nil {
+			h.Write(b)
+		}
+	}
+	gw.siteDigest = digestString(h)
+	return
+}
+
+// Returns a digest of every input used to render a post body.
+func (gw *GhostWriter) digestPost(post *Post) (out string, err error) {
+	var h = sha256.New()
+	fmt.Fprintf(h, "%v\n", gw.siteDigest)
+	if post.file == "" {
+		err = gw.digestDir(h, post.SrcDir)
+	} else {
+		err = gw.digestPostFiles(h, post)
+	}
+	if err != nil {
+		return
+	}
+	out = digestString(h)
+	return
+}
+
+// Returns a digest of the rendered content of every post.  Any post page may
+// show the bodies of other posts, through .Site.Posts, Prev, Next or
+// RecentPosts, so this is an input to every post page.
+func (gw *GhostWriter) digestBodies() string {
+	var (
+		h   = sha256.New()
+		ids []string
+	)
+	for id := range gw.site.Posts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		post := gw.site.Posts[id]
+		fmt.Fprintf(h, "post:%v\n", id)
+		if b, err := json.Marshal([]interface{}{post.Body, post.Snippet, post.TOC}); err == nil {
+			h.Write(b)
+		}
+	}
+	return digestString(h)
+}
+
+// Returns a digest of every input used to render a post page, given that
+// every body has been rendered.
+func (gw *GhostWriter) digestPage(post *Post) string {
+	var h = sha256.New()
+	fmt.Fprintf(h, "%v\n", gw.bodyDigest)
+	gw.manifest.mu.Lock()
+	if entry, ok := gw.manifest.Entries[fmt.Sprintf("post:%v", post.Id)]; ok {
+		fmt.Fprintf(h, "%v\n", entry.Hash)
+	}
+	gw.manifest.mu.Unlock()
+	return digestString(h)
+}
+
+// Writes a digest of a single-file post and the files it publishes into h.
+func (gw *GhostWriter) digestPostFiles(h hash.Hash, post *Post) (err error) {
+	var names []string
+	if err = gw.digestFile(h, post.file); err != nil {
+		return
+	}
+	if names, err = gw.postFiles(post); err != nil {
+		return
+	}
+	for _, n := range names {
+		if err = gw.digestFile(h, filepath.Join(post.SrcDir, n)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Returns a digest of every post's inputs, used by listing pages which may
+// include the content of any post.
+func (gw *GhostWriter) digestContent() (out string) {
+	var (
+		h    = sha256.New()
+		keys []string
+	)
+	fmt.Fprintf(h, "%v\n", gw.siteDigest)
+	for key := range gw.manifest.Entries {
+		if strings.HasPrefix(key, "post:") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(h, "%v:%v\n", key, gw.manifest.Entries[key].Hash)
+	}
+	return digestString(h)
+}
+
+// Returns a digest of a page rendered from the template at src.
+func (gw *GhostWriter) digestTemplate(src string) (out string, err error) {
+	var h = sha256.New()
+	fmt.Fprintf(h, "%v\n", gw.contentDigest)
+	if err = gw.digestFile(h, src); err != nil {
+		return
+	}
+	out = digestString(h)
+	return
+}
+
+// Returns a digest of a listing page, given its content digest and name.
+func digestListing(content string, parts ...interface{}) string {
+	var h = sha256.New()
+	fmt.Fprintf(h, "%v\n", content)
+	fmt.Fprintln(h, parts...)
+	return digestString(h)
+}
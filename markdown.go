@@ -0,0 +1,126 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"gopkg.in/russross/blackfriday.v2"
+)
+
+// Names of the Markdown parser extensions which can be set in MarkdownMeta.
+var MARKDOWN_EXTENSIONS = map[string]blackfriday.Extensions{
+	"no_intra_emphasis":          blackfriday.NoIntraEmphasis,
+	"tables":                     blackfriday.Tables,
+	"fenced_code":                blackfriday.FencedCode,
+	"autolink":                   blackfriday.Autolink,
+	"strikethrough":              blackfriday.Strikethrough,
+	"lax_html_blocks":            blackfriday.LaxHTMLBlocks,
+	"space_headings":             blackfriday.SpaceHeadings,
+	"hard_line_break":            blackfriday.HardLineBreak,
+	"tab_size_eight":             blackfriday.TabSizeEight,
+	"footnotes":                  blackfriday.Footnotes,
+	"no_empty_line_before_block": blackfriday.NoEmptyLineBeforeBlock,
+	"heading_ids":                blackfriday.HeadingIDs,
+	"titleblock":                 blackfriday.Titleblock,
+	"auto_heading_ids":           blackfriday.AutoHeadingIDs,
+	"backslash_line_break":       blackfriday.BackslashLineBreak,
+	"definition_lists":           blackfriday.DefinitionLists,
+}
+
+// Names of the HTML renderer flags which can be set in MarkdownMeta.  Flags
+// which would produce more than a post body are left out.
+var MARKDOWN_FLAGS = map[string]blackfriday.HTMLFlags{
+	"skip_html":                 blackfriday.SkipHTML,
+	"skip_images":               blackfriday.SkipImages,
+	"skip_links":                blackfriday.SkipLinks,
+	"safelink":                  blackfriday.Safelink,
+	"nofollow_links":            blackfriday.NofollowLinks,
+	"noreferrer_links":          blackfriday.NoreferrerLinks,
+	"href_target_blank":         blackfriday.HrefTargetBlank,
+	"use_xhtml":                 blackfriday.UseXHTML,
+	"footnote_return_links":     blackfriday.FootnoteReturnLinks,
+	"smartypants":               blackfriday.Smartypants,
+	"smartypants_fractions":     blackfriday.SmartypantsFractions,
+	"smartypants_dashes":        blackfriday.SmartypantsDashes,
+	"smartypants_latex_dashes":  blackfriday.SmartypantsLatexDashes,
+	"smartypants_angled_quotes": blackfriday.SmartypantsAngledQuotes,
+	"smartypants_quotes_nbsp":   blackfriday.SmartypantsQuotesNBSP,
+}
+
+// Computes the parser extensions and renderer flags for Markdown, starting
+// from the blackfriday defaults and applying each meta in turn.  Later metas
+// override earlier ones, so a post can override the site settings.
+func markdownOptions(metas ...*MarkdownMeta) (ext blackfriday.Extensions, flags blackfriday.HTMLFlags, err error) {
+	ext = blackfriday.CommonExtensions
+	flags = blackfriday.CommonHTMLFlags
+	for _, meta := range metas {
+		if meta == nil {
+			continue
+		}
+		for name, on := range meta.Extensions {
+			value, ok := MARKDOWN_EXTENSIONS[name]
+			switch {
+			case !ok:
+				return 0, 0, fmt.Errorf("Unknown markdown extension %q", name)
+			case on:
+				ext |= value
+			default:
+				ext &^= value
+			}
+		}
+		for name, on := range meta.Flags {
+			value, ok := MARKDOWN_FLAGS[name]
+			switch {
+			case !ok:
+				return 0, 0, fmt.Errorf("Unknown markdown flag %q", name)
+			case on:
+				flags |= value
+			default:
+				flags &^= value
+			}
+		}
+	}
+	return
+}
+
+// Renders Markdown with the options from the site and post meta.
+func renderMarkdown(post *Post, body []byte) (out string, err error) {
+	var (
+		metas     []*MarkdownMeta
+		ext       blackfriday.Extensions
+		flags     blackfriday.HTMLFlags
+		renderer  *blackfriday.HTMLRenderer
+		highlight = &HighlightMeta{}
+	)
+	if post.site != nil && post.site.meta != nil {
+		metas = append(metas, &post.site.meta.Markdown)
+	}
+	if post.meta != nil {
+		metas = append(metas, &post.meta.Markdown)
+	}
+	if ext, flags, err = markdownOptions(metas...); err != nil {
+		return
+	}
+	renderer = blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: flags,
+	})
+	if post.site != nil && post.site.meta != nil {
+		highlight = &post.site.meta.Highlight
+	}
+	out = string(blackfriday.Run(body,
+		blackfriday.WithRenderer(&highlightRenderer{renderer, highlight}),
+		blackfriday.WithExtensions(ext)))
+	return
+}
@@ -24,18 +24,92 @@ type SiteMeta struct {
 	PathFormat  string
 	DateFormat  string
 	TagsFormat  string
+	YearFormat  string
+	MonthFormat string
 	RecentCount int
+	PageSize    int
+	PageFormat  string
+	Feed        FeedMeta
+	Sitemap     SitemapMeta
+	Robots      RobotsMeta
+	Keep        []string
+	Server      ServerMeta
+	Exif        ExifMeta
+	Renderers   map[string]RendererMeta
+	Markdown    MarkdownMeta
+	Highlight   HighlightMeta
 	Metadata    map[string]string
 }
 
+// Controls syntax highlighting of fenced code blocks.  LineNumbers numbers
+// every block unless its info string says "nolinenos".  Theme selects the
+// stylesheet written by the "styles" action.
+type HighlightMeta struct {
+	LineNumbers bool
+	Theme       string
+}
+
+// Turns Markdown parser extensions and HTML renderer flags on or off, by
+// name.  Anything not mentioned keeps the blackfriday default.
+type MarkdownMeta struct {
+	Extensions map[string]bool
+	Flags      map[string]bool
+}
+
+// Renders post bodies with the given extension by piping them through
+// Command, given as the program followed by its arguments.
+type RendererMeta struct {
+	Command []string
+}
+
+// Controls the EXIF metadata of JPEG files copied into the output.  Strip is
+// "gps" to remove location data and XMP, "all" to remove everything but the
+// orientation, or empty to copy files unchanged.
+type ExifMeta struct {
+	Strip string
+}
+
+type FeedMeta struct {
+	Count    int
+	FullBody bool
+	AtomPath string
+	RssPath  string
+}
+
+type SitemapMeta struct {
+	Path string
+}
+
+type RobotsMeta struct {
+	Path     string
+	Disallow []string
+}
+
+type ServerMeta struct {
+	CleanURLs    bool
+	Address      string
+	ReadTimeout  string
+	WriteTimeout string
+	IdleTimeout  string
+	Cache        []CacheMeta
+}
+
+type CacheMeta struct {
+	Path    string
+	Control string
+}
+
 type PostMeta struct {
 	Tags     []string
 	Title    string
 	Date     string
+	Updated  string
 	Slug     string
+	Draft    bool
 	Scripts  []ScriptMeta
 	Styles   []string
 	Images   map[string]ImageMeta
+	Markdown MarkdownMeta
 	Metadata map[string]string
 }
 
@@ -44,8 +118,15 @@ type ScriptMeta struct {
 	Async bool
 }
 
+// A variant is either a separate file, given by Src, or generated by resizing
+// the image to Width and Height.  Fit is one of "contain" (the default),
+// "cover" or "stretch", Quality applies to JPEG output.
 type ImageVariantMeta struct {
-	Src *string
+	Src     *string
+	Width   int
+	Height  int
+	Fit     string
+	Quality int
 }
 
 type ImageMeta struct {
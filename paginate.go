@@ -0,0 +1,188 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// A link to a single page of a paginated listing.
+type PageLink struct {
+	Number int
+	Path   string
+}
+
+// Represents one page of a paginated list of posts for templating purposes.
+type Paginator struct {
+	Posts   Posts
+	pages   []*PageLink
+	current int
+}
+
+// Returns the page currently being rendered.
+func (p *Paginator) Current() *PageLink {
+	return p.pages[p.current]
+}
+
+// Returns links to every page in the listing.
+func (p *Paginator) Pages() []*PageLink {
+	return p.pages
+}
+
+// Returns the total number of pages in the listing.
+func (p *Paginator) Total() int {
+	return len(p.pages)
+}
+
+// Returns the previous page, or nil if this is the first page.
+func (p *Paginator) Prev() *PageLink {
+	if p.current > 0 {
+		return p.pages[p.current-1]
+	}
+	return nil
+}
+
+// Returns the next page, or nil if this is the last page.
+func (p *Paginator) Next() *PageLink {
+	if p.current < len(p.pages)-1 {
+		return p.pages[p.current+1]
+	}
+	return nil
+}
+
+// Passed to listing templates, which may call Paginate to request that a
+// list of posts be split across several pages.
+type Pager struct {
+	site   *Site
+	base   string
+	number int
+	total  int
+}
+
+// Creates a Pager for rendering page number of the listing at base.
+func NewPager(site *Site, base string, number int) *Pager {
+	return &Pager{
+		site:   site,
+		base:   base,
+		number: number,
+	}
+}
+
+// Returns the path of the given page number of this listing.
+func (p *Pager) pagePath(number int) (out string, err error) {
+	var (
+		t *template.Template
+		b *bytes.Buffer
+	)
+	if number <= 1 {
+		return p.base, nil
+	}
+	if t, err = p.site.PageTemplate(); err != nil {
+		return
+	}
+	b = bytes.NewBufferString("")
+	if err = t.Execute(b, map[string]interface{}{"Page": number}); err != nil {
+		return
+	}
+	out = path.Join(p.base, b.String())
+	if strings.HasSuffix(b.String(), "/") {
+		out += "/"
+	}
+	return
+}
+
+// Splits posts into pages and returns the page currently being rendered.
+// An optional page size overrides the size configured for the site.
+func (p *Pager) Paginate(posts Posts, size ...int) (out *Paginator, err error) {
+	var (
+		perPage = p.site.PageSize()
+		start   int
+		end     int
+		link    string
+	)
+	if len(size) > 0 && size[0] > 0 {
+		perPage = size[0]
+	}
+	p.total = (len(posts) + perPage - 1) / perPage
+	if p.total < 1 {
+		p.total = 1
+	}
+	out = &Paginator{
+		pages:   make([]*PageLink, p.total),
+		current: p.number - 1,
+	}
+	for i := 0; i < p.total; i++ {
+		if link, err = p.pagePath(i + 1); err != nil {
+			return
+		}
+		out.pages[i] = &PageLink{Number: i + 1, Path: link}
+	}
+	if out.current >= p.total {
+		out.current = p.total - 1
+	}
+	start = out.current * perPage
+	if end = start + perPage; end > len(posts) {
+		end = len(posts)
+	}
+	out.Posts = posts[start:end]
+	return
+}
+
+// Renders a listing page to dst.  If the template paginated a list of posts
+// the remaining pages are rendered beneath base using the page format.
+// Returns the paths of all files written.
+func (gw *GhostWriter) renderPaged(base string, dst string, data map[string]interface{}, render func(map[string]interface{}) (string, error)) (files []string, err error) {
+	var (
+		pager    *Pager
+		pageData map[string]interface{}
+		str      string
+		p        string
+	)
+	for number := 1; ; number++ {
+		pager = NewPager(gw.site, base, number)
+		pageData = map[string]interface{}{"Pager": pager}
+		for k, v := range data {
+			pageData[k] = v
+		}
+		if str, err = render(pageData); err != nil {
+			return
+		}
+		gw.fs.MkdirAll(path.Dir(dst), 0755)
+		if err = writeFile(gw, str, dst); err != nil {
+			return
+		}
+		files = append(files, dst)
+		if number >= pager.total {
+			return
+		}
+		if p, err = pager.pagePath(number + 1); err != nil {
+			return
+		}
+		dst = path.Join(gw.args.dst, p, "index.html")
+		gw.pages = append(gw.pages, gw.pageURL(dst))
+		gw.log.Printf("Rendering page %v to %v\n", number+1, dst)
+	}
+}
+
+// Adds the pages after the first of a listing restored from the manifest to
+// the sitemap.
+func (gw *GhostWriter) cachedPages(entry *ManifestEntry) {
+	for i := 1; i < len(entry.Files); i++ {
+		gw.pages = append(gw.pages, gw.pageURL(path.Join(gw.args.dst, entry.Files[i])))
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"net/url"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -30,7 +31,9 @@ type Post struct {
 	Id      string
 	Body    string
 	Snippet string
+	TOC     []*TOCEntry
 	SrcDir  string
+	file    string // Source of a single-file post, empty for post directories.
 	meta    *PostMeta
 	site    *Site
 	images  map[string]*Image
@@ -44,26 +47,60 @@ func NewPost(id string, srcDir string, site *Site) *Post {
 	}
 }
 
-// Parses post metadata at the supplied path and initializes the Post structure.
-// If any fields are invalid, err will be non-nil.
-func (p *Post) ParseMeta(gw *GhostWriter, path string) (err error) {
-	src := filepath.Join(gw.args.src, path)
-	p.meta = &PostMeta{}
-	if err = gw.unyaml(src, p.meta); err != nil {
-		return
+// Creates a post from a single file holding front matter and the post body.
+// Relative paths in the post resolve against the directory of the file.
+func NewFilePost(id string, file string, site *Site) *Post {
+	return &Post{
+		Id:     id,
+		SrcDir: filepath.Dir(file),
+		file:   file,
+		site:   site,
 	}
-	if p.meta.Date == "" {
-		err = fmt.Errorf("Post meta must include date")
-		return
+}
+
+// Returns the names of the files, relative to SrcDir, which are published
+// alongside the post.  A post directory publishes all of its files, a
+// single-file post only the images declared in its metadata.
+func (gw *GhostWriter) postFiles(p *Post) (names []string, err error) {
+	if p.file == "" {
+		return gw.readDir(p.SrcDir)
 	}
-	if p.meta.Slug == "" {
-		err = fmt.Errorf("Post meta must include slug")
-		return
+	var seen = map[string]bool{}
+	for _, image := range p.meta.Images {
+		srcs := []string{image.Src}
+		for _, variant := range image.Variants {
+			if variant.Src != nil {
+				srcs = append(srcs, *variant.Src)
+			}
+		}
+		for _, src := range srcs {
+			if src != "" && !seen[src] {
+				seen[src] = true
+				names = append(names, src)
+			}
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// Parses post metadata from the post's meta.yaml and the front matter of its
+// body file, or from the front matter of a single-file post, and initializes
+// the Post structure.
+// If any fields are invalid, err will be non-nil.
+func (p *Post) ParseMeta(gw *GhostWriter) (err error) {
+	var metaSrc string
+	if p.file == "" {
+		metaSrc = filepath.Join(p.SrcDir, "meta.yaml")
 	}
-	if p.meta.Title == "" {
-		err = fmt.Errorf("Post meta must include title")
+	if p.meta, err = gw.parsePostMeta(gw.postBodySrc(p), metaSrc); err != nil {
 		return
 	}
+	if p.meta.Updated != "" {
+		if _, err = time.Parse(p.site.meta.DateFormat, p.meta.Updated); err != nil {
+			return fmt.Errorf("Post meta has invalid updated date: %v", err)
+		}
+	}
 	p.loadImageData(gw)
 	return
 }
@@ -98,6 +135,16 @@ func (p *Post) SureDate() (t time.Time) {
 	return
 }
 
+// Returns the date the post was last updated, as configured in the post
+// metadata.  Falls back to the post date if no update date was supplied.
+func (p *Post) Updated() (t time.Time) {
+	if p.meta.Updated == "" {
+		return p.SureDate()
+	}
+	t, _ = time.Parse(p.site.meta.DateFormat, p.meta.Updated) // Checked by ParseMeta.
+	return
+}
+
 // Returns the date of the post in the configured path format.
 func (p *Post) DatePath() (s string) {
 	var t time.Time
@@ -118,11 +165,20 @@ func (p *Post) Slug() (s string) {
 }
 
 // Returns the human-friendly title of the post.
+// Drafts are marked so they are not mistaken for published posts.
 func (p *Post) Title() (s string) {
 	s = p.meta.Title
+	if p.Draft() {
+		s = fmt.Sprintf("[DRAFT] %v", s)
+	}
 	return
 }
 
+// Returns true if the post is marked as a draft in the post metadata.
+func (p *Post) Draft() bool {
+	return p.meta.Draft
+}
+
 // Returns the relative URL path for the post.
 func (p *Post) Path() (out string, err error) {
 	var (
@@ -209,6 +265,15 @@ func (p *Post) Images() map[string]*Image {
 	return p.images
 }
 
+// Returns the keys of the post's images, sorted.
+func (p *Post) imageKeys() (keys []string) {
+	for key := range p.images {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return
+}
+
 // Returns a single image associated with the post, by key.
 func (p *Post) Image(key string) (out *Image, err error) {
 	var exists bool
@@ -261,6 +326,16 @@ func (p *Post) Next() *Post {
 	return p.site.NextPost(p)
 }
 
+// Renders the post's table of contents as nested lists of links.  Optional
+// arguments limit it to headings from a minimum to a maximum level.
+func (p *Post) TOCList(levels ...int) (s string, err error) {
+	var min, max int
+	if min, max, err = tocLevels(levels); err != nil {
+		return
+	}
+	return renderTOC(p.TOC, min, max), nil
+}
+
 // Returns the previous post, chronologically.
 func (p *Post) Prev() *Post {
 	return p.site.PrevPost(p)
@@ -0,0 +1,184 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Converts the templated body of a post into HTML.
+type BodyRenderer func(post *Post, body []byte) (out string, err error)
+
+// Extensions of body files, in the order they are looked for.
+var DEFAULT_BODY_EXTENSIONS = []string{".md", ".html", ".txt"}
+
+var (
+	bodyRenderersMu sync.Mutex
+	bodyRenderers   = map[string]BodyRenderer{
+		".md":   renderMarkdown,
+		".html": renderHTML,
+		".txt":  renderText,
+	}
+)
+
+// Registers a renderer for post bodies stored in files with the given
+// extension, such as ".rst".  Replaces any renderer already registered for
+// the extension.
+func RegisterBodyRenderer(ext string, renderer BodyRenderer) {
+	bodyRenderersMu.Lock()
+	defer bodyRenderersMu.Unlock()
+	bodyRenderers[normalizeExt(ext)] = renderer
+}
+
+// Removes the renderer registered for body files with the given extension.
+func unregisterBodyRenderer(ext string) {
+	bodyRenderersMu.Lock()
+	defer bodyRenderersMu.Unlock()
+	delete(bodyRenderers, normalizeExt(ext))
+}
+
+// Returns ext with a leading dot.
+func normalizeExt(ext string) string {
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return strings.ToLower(ext)
+}
+
+// Passes HTML through unchanged.
+func renderHTML(post *Post, body []byte) (string, error) {
+	return string(body), nil
+}
+
+// Escapes plain text and preserves its formatting.  Leading blank lines,
+// such as those left in place of front matter, are dropped.
+func renderText(post *Post, body []byte) (string, error) {
+	text := strings.TrimLeft(string(body), "\n")
+	return fmt.Sprintf("<pre>%v</pre>", html.EscapeString(text)), nil
+}
+
+// Returns a renderer which pipes bodies through an external command and
+// uses its output.  The post's source directory is passed to the command in
+// GHOSTWRITER_POST_DIR.
+func commandRenderer(command []string) BodyRenderer {
+	return func(post *Post, body []byte) (out string, err error) {
+		var (
+			cmd    *exec.Cmd
+			stdout bytes.Buffer
+			stderr bytes.Buffer
+		)
+		if len(command) == 0 {
+			return "", fmt.Errorf("Renderer command is empty")
+		}
+		cmd = exec.Command(command[0], command[1:]...)
+		cmd.Env = append(os.Environ(), "GHOSTWRITER_POST_DIR="+post.SrcDir)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err = cmd.Run(); err != nil {
+			return "", fmt.Errorf("%v: %v %v", strings.Join(command, " "), err, strings.TrimSpace(stderr.String()))
+		}
+		return stdout.String(), nil
+	}
+}
+
+// Returns the renderer for body files with the given extension, preferring
+// commands configured in the site meta over renderers registered in Go.
+func (gw *GhostWriter) bodyRenderer(ext string) (renderer BodyRenderer, ok bool) {
+	ext = normalizeExt(ext)
+	if gw.site != nil && gw.site.meta != nil {
+		for key, meta := range gw.site.meta.Renderers {
+			if normalizeExt(key) == ext {
+				return commandRenderer(meta.Command), true
+			}
+		}
+	}
+	bodyRenderersMu.Lock()
+	defer bodyRenderersMu.Unlock()
+	renderer, ok = bodyRenderers[ext]
+	return
+}
+
+// Returns the extensions which body files may have, in the order they are
+// looked for: the defaults, then other registered and configured formats.
+func (gw *GhostWriter) bodyExtensions() (exts []string) {
+	var (
+		seen  = map[string]bool{}
+		extra []string
+	)
+	for _, ext := range DEFAULT_BODY_EXTENSIONS {
+		seen[ext] = true
+	}
+	bodyRenderersMu.Lock()
+	for ext := range bodyRenderers {
+		if !seen[ext] {
+			seen[ext] = true
+			extra = append(extra, ext)
+		}
+	}
+	bodyRenderersMu.Unlock()
+	if gw.site != nil && gw.site.meta != nil {
+		for key := range gw.site.meta.Renderers {
+			if ext := normalizeExt(key); !seen[ext] {
+				seen[ext] = true
+				extra = append(extra, ext)
+			}
+		}
+	}
+	sort.Strings(extra)
+	return append(append([]string{}, DEFAULT_BODY_EXTENSIONS...), extra...)
+}
+
+// Returns true if files with the extension of p can hold a post body.
+func (gw *GhostWriter) isBodyFile(p string) bool {
+	_, ok := gw.bodyRenderer(filepath.Ext(p))
+	return ok
+}
+
+// Returns the path of the file holding the post body.  Post directories use
+// the first body file found, or body.md if there is none.
+func (gw *GhostWriter) postBodySrc(p *Post) string {
+	if p.file != "" {
+		return p.file
+	}
+	for _, ext := range gw.bodyExtensions() {
+		src := filepath.Join(p.SrcDir, "body"+ext)
+		if _, err := gw.fs.Stat(src); err == nil {
+			return src
+		}
+	}
+	return filepath.Join(p.SrcDir, "body.md")
+}
+
+// Converts the templated body of a post to HTML with the renderer for the
+// extension of src.
+func (gw *GhostWriter) renderBody(post *Post, src string, body []byte) (out string, err error) {
+	var (
+		renderer BodyRenderer
+		ok       bool
+	)
+	if renderer, ok = gw.bodyRenderer(filepath.Ext(src)); !ok {
+		return "", fmt.Errorf("No renderer for %v files", filepath.Ext(src))
+	}
+	return renderer(post, body)
+}
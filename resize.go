@@ -0,0 +1,243 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Ways of fitting an image into a variant's target width and height.
+const (
+	// Scales the image to fit within the target size, preserving its aspect
+	// ratio.  Images are never enlarged.
+	FIT_CONTAIN = "contain"
+	// Scales and crops the image to exactly fill the target size.
+	FIT_COVER = "cover"
+	// Scales the image to exactly the target size, distorting if needed.
+	FIT_STRETCH = "stretch"
+)
+
+// Computes the size of a variant of a srcW by srcH image, given the target
+// size and fit mode.  A zero target width or height is derived from the
+// other using the aspect ratio of the source.
+func variantSize(srcW int, srcH int, width int, height int, fit string) (w int, h int, err error) {
+	if srcW <= 0 || srcH <= 0 {
+		return 0, 0, fmt.Errorf("Invalid source size %vx%v", srcW, srcH)
+	}
+	if width < 0 || height < 0 || (width == 0 && height == 0) {
+		return 0, 0, fmt.Errorf("Variant must declare a positive width or height")
+	}
+	if fit == "" {
+		fit = FIT_CONTAIN
+	}
+	switch {
+	case height == 0:
+		w, h = width, int(math.Round(float64(srcH)*float64(width)/float64(srcW)))
+	case width == 0:
+		w, h = int(math.Round(float64(srcW)*float64(height)/float64(srcH))), height
+	default:
+		switch fit {
+		case FIT_CONTAIN:
+			scale := math.Min(float64(width)/float64(srcW), float64(height)/float64(srcH))
+			w = int(math.Round(float64(srcW) * scale))
+			h = int(math.Round(float64(srcH) * scale))
+		case FIT_COVER, FIT_STRETCH:
+			w, h = width, height
+		default:
+			return 0, 0, fmt.Errorf("Unknown fit mode %q", fit)
+		}
+	}
+	if fit == FIT_CONTAIN && (w > srcW || h > srcH) {
+		w, h = srcW, srcH
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+	return
+}
+
+// Returns the centered region of a srcW by srcH image which has the same
+// aspect ratio as a w by h image.
+func coverCrop(srcW int, srcH int, w int, h int) image.Rectangle {
+	var (
+		cw = srcW
+		ch = srcH
+	)
+	if float64(srcW)/float64(srcH) > float64(w)/float64(h) {
+		cw = int(math.Round(float64(srcH) * float64(w) / float64(h)))
+	} else {
+		ch = int(math.Round(float64(srcW) * float64(h) / float64(w)))
+	}
+	x := (srcW - cw) / 2
+	y := (srcH - ch) / 2
+	return image.Rect(x, y, x+cw, y+ch)
+}
+
+// Produces a w by h copy of img, cropping first if fit is FIT_COVER.
+func fitImage(img image.Image, w int, h int, fit string) *image.RGBA {
+	var (
+		b    = img.Bounds()
+		crop = image.Rect(0, 0, b.Dx(), b.Dy())
+	)
+	if fit == FIT_COVER {
+		crop = coverCrop(b.Dx(), b.Dy(), w, h)
+	}
+	src := image.NewRGBA(image.Rect(0, 0, crop.Dx(), crop.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min.Add(crop.Min), draw.Src)
+	return resizeRGBA(src, w, h)
+}
+
+// Returns img transformed for display according to an EXIF orientation.
+func orientImage(img image.Image, orientation int) image.Image {
+	var (
+		b   = img.Bounds()
+		w   = b.Dx()
+		h   = b.Dy()
+		src *image.RGBA
+		dst *image.RGBA
+	)
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	src = image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	} else {
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):])
+		}
+	}
+	return dst
+}
+
+// The source samples, and their weights, which make up one output sample.
+type resampleTaps struct {
+	index  []int
+	weight []float64
+}
+
+// Computes resampling weights for scaling n samples to m samples.  Shrinking
+// averages the area covered by each output sample, enlarging interpolates
+// linearly between neighbors.
+func resampleWeights(n int, m int) []resampleTaps {
+	var (
+		scale = float64(n) / float64(m)
+		out   = make([]resampleTaps, m)
+	)
+	for i := range out {
+		t := &out[i]
+		if scale <= 1 {
+			center := (float64(i)+0.5)*scale - 0.5
+			j := int(math.Floor(center))
+			f := center - float64(j)
+			t.index = []int{clampInt(j, 0, n-1), clampInt(j+1, 0, n-1)}
+			t.weight = []float64{1 - f, f}
+			continue
+		}
+		lo := float64(i) * scale
+		hi := lo + scale
+		total := 0.0
+		for j := int(lo); j < n && float64(j) < hi; j++ {
+			w := math.Min(hi, float64(j+1)) - math.Max(lo, float64(j))
+			if w <= 0 {
+				continue
+			}
+			t.index = append(t.index, j)
+			t.weight = append(t.weight, w)
+			total += w
+		}
+		for k := range t.weight {
+			t.weight[k] /= total
+		}
+	}
+	return out
+}
+
+func clampInt(v int, min int, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+// Resamples src, which must have its origin at zero, to w by h.
+func resizeRGBA(src *image.RGBA, w int, h int) *image.RGBA {
+	var (
+		sw  = src.Bounds().Dx()
+		sh  = src.Bounds().Dy()
+		xw  = resampleWeights(sw, w)
+		yw  = resampleWeights(sh, h)
+		tmp = make([]float64, w*sh*4)
+		dst = image.NewRGBA(image.Rect(0, 0, w, h))
+	)
+	// Horizontal pass into tmp, then vertical pass into dst.
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, taps := range xw {
+			o := (y*w + x) * 4
+			for k, j := range taps.index {
+				for c := 0; c < 4; c++ {
+					tmp[o+c] += taps.weight[k] * float64(row[j*4+c])
+				}
+			}
+		}
+	}
+	for y, taps := range yw {
+		for x := 0; x < w; x++ {
+			var acc [4]float64
+			for k, j := range taps.index {
+				o := (j*w + x) * 4
+				for c := 0; c < 4; c++ {
+					acc[c] += taps.weight[k] * tmp[o+c]
+				}
+			}
+			o := y*dst.Stride + x*4
+			for c := 0; c < 4; c++ {
+				dst.Pix[o+c] = uint8(clampInt(int(math.Round(acc[c])), 0, 255))
+			}
+		}
+	}
+	return dst
+}
@@ -15,37 +15,174 @@
 package main
 
 import (
+	"bytes"
+	"github.com/kurrik/fauxfile"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 )
 
 type Handler struct {
-	gw *GhostWriter
+	gw       *GhostWriter
+	reloader *Reloader
+	config   ServerMeta
+	etagMu   sync.Mutex
+	etags    map[string]etagEntry
 }
 
+// Name of the page served for missing paths, rendered from 404.tmpl.
+const NOT_FOUND_PAGE = "404.html"
+
 // Handles all HTTP requests.
 func (h *Handler) HandleRequest(w http.ResponseWriter, r *http.Request) {
 	var (
 		err  error
 		path string
 		info os.FileInfo
+		ext  = filepath.Ext(r.URL.Path)
 	)
 	h.gw.log.Printf("Path: %q", r.URL.Path)
+	if status := h.gw.Status(); status.Error != nil {
+		if ext == "" || ext == ".html" {
+			h.serveErrorOverlay(w, r, status)
+			return
+		}
+	}
+	if h.config.CleanURLs && ext == ".html" {
+		// Canonicalize /foo.html to /foo and /foo/index.html to /foo/.
+		clean := strings.TrimSuffix(r.URL.Path, ".html")
+		if strings.HasSuffix(clean, "/index") {
+			clean = strings.TrimSuffix(clean, "index")
+		}
+		h.redirect(w, r, clean)
+		return
+	}
 	path = filepath.Join(h.gw.args.dst, r.URL.Path)
-	if info, err = h.gw.fs.Stat(path); err != nil {
-		http.NotFound(w, r)
+	if info, err = h.gw.fs.Stat(path); err != nil && h.config.CleanURLs && ext == "" {
+		path = path + ".html"
+		info, err = h.gw.fs.Stat(path)
+	}
+	if err != nil {
+		h.notFound(w, r)
 		return
 	}
 	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			h.redirect(w, r, r.URL.Path+"/")
+			return
+		}
 		path = filepath.Join(path, "index.html")
 		if info, err = h.gw.fs.Stat(path); err != nil {
-			http.NotFound(w, r)
+			h.notFound(w, r)
+			return
+		}
+	}
+	h.serveFile(w, r, path, info, http.StatusOK)
+}
+
+// Permanently redirects the request to p, preserving any query string.
+func (h *Handler) redirect(w http.ResponseWriter, r *http.Request, p string) {
+	if r.URL.RawQuery != "" {
+		p = p + "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, p, http.StatusMovedPermanently)
+}
+
+// Serves the rendered 404 page if the site has one, with a 404 status.
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request) {
+	var (
+		path = filepath.Join(h.gw.args.dst, NOT_FOUND_PAGE)
+		info os.FileInfo
+		err  error
+	)
+	if info, err = h.gw.fs.Stat(path); err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	h.serveFile(w, r, path, info, http.StatusNotFound)
+}
+
+// Serves the file at path with the given status code.  Compressible files
+// are gzipped, using a precompressed .gz sidecar if one exists.  Live reload
+// support is added to HTML files if enabled.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, path string, info os.FileInfo, code int) {
+	var (
+		ctype  = mime.TypeByExtension(filepath.Ext(path))
+		gz     = isCompressible(ctype) && acceptsGzip(r)
+		inject = h.reloader != nil && filepath.Ext(path) == ".html"
+		f      fauxfile.File
+		data   string
+		body   []byte
+		etag   string
+		err    error
+	)
+	if ctype != "" {
+		w.Header().Set("Content-Type", ctype)
+	}
+	if control := h.cacheControl(r.URL.Path); control != "" {
+		w.Header().Set("Cache-Control", control)
+	}
+	if isCompressible(ctype) {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	if gz && !inject {
+		if sinfo, serr := h.gw.fs.Stat(path + ".gz"); serr == nil && !sinfo.IsDir() {
+			w.Header().Set("Content-Encoding", "gzip")
+			path, info, gz = path+".gz", sinfo, false
+		}
+	}
+	if gz || inject {
+		// Content is transformed, so must be buffered.
+		if data, err = h.gw.readFile(path); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		body = []byte(data)
+		if inject {
+			w.Header().Set("Cache-Control", "no-cache")
+			body = injectLiveReload(body)
+		}
+		if gz {
+			if body, err = gzipBytes(body); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+		}
+		if etag, err = contentETag(bytes.NewReader(body)); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+		h.serveContent(w, r, path, info, bytes.NewReader(body), code)
+		return
+	}
+	if etag, err = h.fileETag(path, info); err == nil {
+		w.Header().Set("ETag", etag)
+	}
+	if f, err = h.gw.fs.Open(path); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	h.serveContent(w, r, path, info, f, code)
+}
+
+// Writes content to the response.  Responses other than 200 OK are written
+// in full, since conditional and range requests only apply to found files.
+func (h *Handler) serveContent(w http.ResponseWriter, r *http.Request, path string, info os.FileInfo, content io.ReadSeeker, code int) {
+	if code == http.StatusOK {
+		http.ServeContent(w, r, path, info.ModTime(), content)
+		return
+	}
+	w.Header().Del("ETag")
+	w.WriteHeader(code)
+	if r.Method != "HEAD" {
+		io.Copy(w, content)
 	}
-	http.ServeFile(w, r, path)
 }
 
 // Wraps http requests in a closure so request handlers can access state.
@@ -55,22 +192,69 @@ func GetHandler(h *Handler) func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Reads the server section of the site configuration.  The server is not
+// restarted between builds, so this is read once when serving starts.
+func (gw *GhostWriter) parseServerMeta() ServerMeta {
+	var (
+		src  = filepath.Join(gw.args.src, gw.args.config)
+		meta = &SiteMeta{}
+	)
+	if err := gw.unyaml(src, meta); err != nil {
+		gw.log.Printf("Could not read server config from %v: %v\n", src, err)
+	}
+	return meta.Server
+}
+
+// Parses a timeout from the server config, returning def if it is unset or
+// invalid.
+func (gw *GhostWriter) serverTimeout(name string, value string, def time.Duration) time.Duration {
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		gw.log.Printf("Invalid server %v %q, using %v: %v\n", name, value, def, err)
+		return def
+	}
+	return d
+}
+
 // Serve the given GhostWriter config over HTTP.
+// The address flag takes precedence over the address in the server config.
 func Serve(gw *GhostWriter) (err error) {
 	var (
 		server  *http.Server
 		mux     *http.ServeMux
 		handler *Handler
+		config  = gw.parseServerMeta()
+		addr    = gw.args.addr
 	)
+	if !gw.args.addrSet && config.Address != "" {
+		addr = config.Address
+	}
 	mux = http.NewServeMux()
-	handler = &Handler{gw: gw}
+	handler = &Handler{
+		gw:       gw,
+		reloader: gw.reloader,
+		config:   config,
+	}
 	mux.HandleFunc("/", GetHandler(handler))
+	mux.HandleFunc(STATUS_PATH, handler.HandleStatus)
+	if handler.reloader != nil {
+		mux.HandleFunc(LIVE_RELOAD_PATH, handler.HandleLiveReload)
+		mux.HandleFunc(LIVE_RELOAD_SCRIPT_PATH, handler.HandleLiveReloadScript)
+	}
 	server = &http.Server{
-		Addr:           gw.args.addr,
+		Addr:           addr,
 		Handler:        mux,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		ReadTimeout:    gw.serverTimeout("readtimeout", config.ReadTimeout, 10*time.Second),
+		WriteTimeout:   gw.serverTimeout("writetimeout", config.WriteTimeout, 10*time.Second),
+		IdleTimeout:    gw.serverTimeout("idletimeout", config.IdleTimeout, 0),
 		MaxHeaderBytes: 1 << 20,
 	}
+	if w := server.WriteTimeout; handler.reloader != nil && w > 0 && w <= LIVE_RELOAD_TIMEOUT {
+		gw.log.Printf("Server writetimeout %v is too short for live reload\n", w)
+	}
+	gw.log.Printf("Serving %v at %v\n", gw.args.dst, addr)
 	return server.ListenAndServe()
 }
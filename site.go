@@ -17,19 +17,25 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"path"
 	"sort"
+	"sync"
 	"text/template"
 	"time"
 )
 
 // Represents the site for templating purposes.
 type Site struct {
-	Posts        map[string]*Post
-	meta         *SiteMeta
-	pathTemplate *template.Template
-	tagsTemplate *template.Template
-	Tags         map[string]Posts
-	Rendered     time.Time
+	Posts         map[string]*Post
+	meta          *SiteMeta
+	mu            sync.Mutex // Guards lazily parsed templates.
+	pathTemplate  *template.Template
+	tagsTemplate  *template.Template
+	pageTemplate  *template.Template
+	yearTemplate  *template.Template
+	monthTemplate *template.Template
+	Tags          map[string]Posts
+	Rendered      time.Time
 }
 
 // Returns the path for a given tag
@@ -39,6 +45,8 @@ func (s *Site) TagPath(tag string) string {
 		b   *bytes.Buffer
 		d   map[string]interface{}
 	)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.tagsTemplate == nil {
 		s.tagsTemplate, err = template.New("tags").Parse(s.meta.TagsFormat)
 		if err != nil {
@@ -55,6 +63,20 @@ func (s *Site) TagPath(tag string) string {
 	return b.String()
 }
 
+// Returns the path of a feed for the given tag, placed next to the tag page.
+// The file name of the feed matches the configured site feed path.
+func (s *Site) tagFeedPath(tag string, feedPath string) string {
+	if feedPath == "" || s.meta.TagsFormat == "" {
+		return ""
+	}
+	return path.Join(s.TagPath(tag), path.Base(feedPath))
+}
+
+// Returns the path of the preferred feed for a given tag.
+func (s *Site) TagFeedPath(tag string) string {
+	return s.tagFeedPath(tag, s.FeedPath())
+}
+
 // Returns a list of TagCount objects, sorted by count.
 func (s *Site) TagCounts() TagCounts {
 	counts := make(TagCounts, len(s.Tags))
@@ -87,6 +109,24 @@ func (s *Site) Email() string {
 	return s.meta.Email
 }
 
+// Returns the path of the site's Atom feed, or an empty string if disabled.
+func (s *Site) AtomPath() string {
+	return s.meta.Feed.AtomPath
+}
+
+// Returns the path of the site's RSS feed, or an empty string if disabled.
+func (s *Site) RSSPath() string {
+	return s.meta.Feed.RssPath
+}
+
+// Returns the path of the site's preferred feed, Atom if configured.
+func (s *Site) FeedPath() string {
+	if s.meta.Feed.AtomPath != "" {
+		return s.meta.Feed.AtomPath
+	}
+	return s.meta.Feed.RssPath
+}
+
 // Returns any additional user-specified metadata.
 func (s *Site) Metadata() map[string]string {
 	return s.meta.Metadata
@@ -144,6 +184,8 @@ func (s *Site) PrevPost(p *Post) *Post {
 
 // Returns a template suitable for rendering post URLs.
 func (s *Site) PathTemplate() (t *template.Template, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.pathTemplate == nil {
 		s.pathTemplate, err = template.New("path").Parse(s.meta.PathFormat)
 		if err != nil {
@@ -153,3 +195,32 @@ func (s *Site) PathTemplate() (t *template.Template, err error) {
 	t = s.pathTemplate
 	return
 }
+
+// Returns the number of posts shown on each page of a paginated listing.
+func (s *Site) PageSize() int {
+	if s.meta.PageSize > 0 {
+		return s.meta.PageSize
+	}
+	if s.meta.RecentCount > 0 {
+		return s.meta.RecentCount
+	}
+	return 10
+}
+
+// Returns a template suitable for rendering paginated listing URLs.
+func (s *Site) PageTemplate() (t *template.Template, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pageTemplate == nil {
+		format := s.meta.PageFormat
+		if format == "" {
+			format = "page/{{.Page}}/"
+		}
+		s.pageTemplate, err = template.New("page").Parse(format)
+		if err != nil {
+			return
+		}
+	}
+	t = s.pageTemplate
+	return
+}
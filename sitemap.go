@@ -0,0 +1,149 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Serializable sitemap document, see https://www.sitemaps.org/protocol.html.
+type sitemapURLSet struct {
+	XMLName xml.Name      `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []*sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+// Path of the sitemap, unless another is configured.
+const DEFAULT_SITEMAP_PATH = "/sitemap.xml"
+
+// Returns the path of the site's sitemap.
+func (s *Site) SitemapPath() string {
+	if s.meta.Sitemap.Path != "" {
+		return s.meta.Sitemap.Path
+	}
+	return DEFAULT_SITEMAP_PATH
+}
+
+// Returns the URL path for an output file in the destination directory.
+// Index files are referenced by their containing directory.
+func (gw *GhostWriter) pageURL(dst string) string {
+	var (
+		rel string
+		err error
+	)
+	if rel, err = filepath.Rel(gw.args.dst, dst); err != nil {
+		rel = dst
+	}
+	rel = "/" + filepath.ToSlash(rel)
+	if path.Base(rel) == "index.html" {
+		rel = strings.TrimSuffix(rel, "index.html")
+	}
+	return rel
+}
+
+// Returns true if the URL path is excluded from crawling in robots.txt.
+func (gw *GhostWriter) isDisallowed(p string) bool {
+	for _, prefix := range gw.site.meta.Robots.Disallow {
+		if prefix != "" && strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Renders sitemap.xml for posts, tag pages and rendered templates.
+func (gw *GhostWriter) renderSitemap() (err error) {
+	var (
+		root    = gw.site.Root()
+		urlset  = &sitemapURLSet{URLs: []*sitemapURL{}}
+		add     func(p string, lastmod time.Time)
+		postp   string
+		tag     string
+		posts   Posts
+		updated time.Time
+	)
+	add = func(p string, lastmod time.Time) {
+		if gw.isDisallowed(p) {
+			return
+		}
+		u := &sitemapURL{Loc: root + p}
+		if !lastmod.IsZero() {
+			u.LastMod = lastmod.Format("2006-01-02")
+		}
+		urlset.URLs = append(urlset.URLs, u)
+	}
+	for _, post := range gw.site.Posts {
+		if postp, err = post.Path(); err != nil {
+			return
+		}
+		add(postp, post.Updated())
+	}
+	if gw.tagsTemplate != "" {
+		for tag, posts = range gw.site.Tags {
+			updated = time.Time{}
+			for _, post := range posts {
+				if post.Updated().After(updated) {
+					updated = post.Updated()
+				}
+			}
+			add(gw.site.TagPath(tag), updated)
+		}
+	}
+	for _, p := range gw.pages {
+		add(p, time.Time{})
+	}
+	sort.Slice(urlset.URLs, func(i int, j int) bool {
+		return urlset.URLs[i].Loc < urlset.URLs[j].Loc
+	})
+	if err = gw.writeXML(gw.site.SitemapPath(), urlset); err != nil {
+		return
+	}
+	return gw.renderRobots()
+}
+
+// Renders robots.txt with configured exclusions and a pointer to the sitemap.
+func (gw *GhostWriter) renderRobots() (err error) {
+	var (
+		robots = gw.site.meta.Robots
+		out    = new(bytes.Buffer)
+		dst    string
+	)
+	if robots.Path == "" {
+		return
+	}
+	fmt.Fprintf(out, "User-agent: *\n")
+	if len(robots.Disallow) == 0 {
+		fmt.Fprintf(out, "Disallow:\n")
+	}
+	for _, prefix := range robots.Disallow {
+		fmt.Fprintf(out, "Disallow: %v\n", prefix)
+	}
+	fmt.Fprintf(out, "\nSitemap: %v%v\n", gw.site.Root(), gw.site.SitemapPath())
+	dst = path.Join(gw.args.dst, robots.Path)
+	gw.fs.MkdirAll(path.Dir(dst), 0755)
+	gw.log.Printf("Writing %v\n", dst)
+	return writeFile(gw, out.String(), dst)
+}
@@ -0,0 +1,168 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Matches the location prefix of text/template errors, such as
+// "template: body:3:10: executing ...".
+var templateErrorRegexp = regexp.MustCompile(`template: ([^:\s]+):(\d+):`)
+
+// Describes a failed build, including the source of the failure if known.
+type BuildError struct {
+	File     string `json:"file,omitempty"`
+	Template string `json:"template,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// Returns a description of the error, prefixed with the failing file.
+func (e *BuildError) Error() string {
+	if e.File == "" {
+		return e.Message
+	}
+	return fmt.Sprintf("%v: %v", e.File, e.Message)
+}
+
+// Annotates err with the file which was being rendered when it occurred,
+// as well as the template name and line, if err came from a template.
+// Errors which are already annotated are returned unchanged.
+func (gw *GhostWriter) buildError(file string, err error) error {
+	var (
+		berr  *BuildError
+		ok    bool
+		match []string
+	)
+	if err == nil {
+		return nil
+	}
+	if berr, ok = err.(*BuildError); ok {
+		return berr
+	}
+	berr = &BuildError{
+		File:    file,
+		Message: err.Error(),
+	}
+	if match = templateErrorRegexp.FindStringSubmatch(berr.Message); match != nil {
+		berr.Template = match[1]
+		berr.Line, _ = strconv.Atoi(match[2])
+	}
+	return berr
+}
+
+// Path of the JSON endpoint describing the outcome of the last build.
+const STATUS_PATH = "/_ghostwriter/status"
+
+// The outcome of the most recent build.  Time is zero until the first build
+// has finished.
+type BuildStatus struct {
+	Ok    bool        `json:"ok"`
+	Time  time.Time   `json:"time"`
+	Error *BuildError `json:"error,omitempty"`
+}
+
+// Records the outcome of a build.
+func (gw *GhostWriter) setStatus(err error) {
+	var status = BuildStatus{
+		Ok:   err == nil,
+		Time: time.Now(),
+	}
+	if err != nil {
+		status.Error = gw.buildError("", err).(*BuildError)
+	}
+	gw.statusMu.Lock()
+	defer gw.statusMu.Unlock()
+	gw.status = status
+}
+
+// Returns the outcome of the most recent build.
+func (gw *GhostWriter) Status() BuildStatus {
+	gw.statusMu.Lock()
+	defer gw.statusMu.Unlock()
+	return gw.status
+}
+
+// Serves the outcome of the most recent build as JSON.
+func (h *Handler) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	var (
+		data []byte
+		err  error
+	)
+	if data, err = json.MarshalIndent(h.gw.Status(), "", "  "); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(data)
+}
+
+// Page shown in place of HTML responses while the last build is failing.
+var errorOverlayTemplate = template.Must(template.New("overlay").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Build failed</title>
+    <style>
+      body { margin: 0; padding: 2em; background: #222; color: #eee; font-family: sans-serif; }
+      h1 { color: #f66; font-size: 1.4em; }
+      dt { color: #aaa; }
+      dd { margin: 0 0 1em 0; font-family: monospace; }
+      pre { padding: 1em; background: #111; color: #fcc; white-space: pre-wrap; }
+    </style>
+  </head>
+  <body>
+    <h1>Build failed</h1>
+    <dl>
+      {{if .Error.File}}<dt>File</dt><dd>{{.Error.File}}</dd>{{end}}
+      {{if .Error.Template}}<dt>Template</dt><dd>{{.Error.Template}}{{if .Error.Line}} line {{.Error.Line}}{{end}}</dd>{{end}}
+      <dt>Time</dt><dd>{{.Time.Format "15:04:05"}}</dd>
+    </dl>
+    <pre>{{.Error.Message}}</pre>
+    {{if .Script}}<script src="{{.Script}}"></script>{{end}}
+  </body>
+</html>
+`))
+
+// Serves a page describing the failing build.
+func (h *Handler) serveErrorOverlay(w http.ResponseWriter, r *http.Request, status BuildStatus) {
+	var (
+		b    bytes.Buffer
+		data = map[string]interface{}{
+			"Error": status.Error,
+			"Time":  status.Time,
+		}
+	)
+	if h.reloader != nil {
+		data["Script"] = LIVE_RELOAD_SCRIPT_PATH
+	}
+	if err := errorOverlayTemplate.Execute(&b, data); err != nil {
+		http.Error(w, status.Error.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write(b.Bytes())
+}
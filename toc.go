@@ -0,0 +1,241 @@
+// Copyright 2017 Arne Roomann-Kurrik
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	headingPattern     = regexp.MustCompile(`(?is)<h([1-6])(\s[^>]*)?>(.*?)</h([1-6])>`)
+	idAttrPattern      = regexp.MustCompile(`(?i)\sid\s*=\s*("[^"]*"|'[^']*')`)
+	tagPattern         = regexp.MustCompile(`<[^>]*>`)
+	tocPlaceholderText = "<!--ghostwriter:toc %d %d-->"
+	tocPlaceholder     = regexp.MustCompile(`<!--ghostwriter:toc (\d+) (\d+)-->`)
+)
+
+// A heading in a post, and the headings nested below it.
+type TOCEntry struct {
+	Level    int
+	Text     string
+	ID       string
+	Children []*TOCEntry
+}
+
+// A heading found in rendered HTML, as byte offsets into the HTML.
+type heading struct {
+	start int
+	end   int
+	level int
+	attrs string
+	inner string
+	id    string
+}
+
+// Returns the headings in body, ignoring ones whose tags don't match.
+func findHeadings(body string) (headings []*heading) {
+	for _, m := range headingPattern.FindAllStringSubmatchIndex(body, -1) {
+		if body[m[2]:m[3]] != body[m[8]:m[9]] {
+			continue
+		}
+		h := &heading{
+			start: m[0],
+			end:   m[1],
+			inner: body[m[6]:m[7]],
+		}
+		h.level, _ = strconv.Atoi(body[m[2]:m[3]])
+		if m[4] != -1 {
+			h.attrs = body[m[4]:m[5]]
+		}
+		if id := idAttrPattern.FindStringSubmatch(h.attrs); id != nil {
+			h.id = html.UnescapeString(id[1][1 : len(id[1])-1])
+		}
+		headings = append(headings, h)
+	}
+	return
+}
+
+// Returns the text content of an HTML fragment.
+func htmlText(s string) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tagPattern.ReplaceAllString(s, ""))), " ")
+}
+
+// Derives an anchor ID from heading text: lower case letters and digits,
+// with everything else collapsed into single dashes.
+func headingID(text string) string {
+	var (
+		b    strings.Builder
+		dash bool
+	)
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
+
+// Gives every heading in body a unique ID and returns the updated body along
+// with its table of contents.  IDs already in the body are kept unless they
+// are repeated, other headings get IDs derived from their text.  Repeated IDs
+// are suffixed with "-1", "-2" and so on, in document order.
+func buildTOC(body string) (out string, toc []*TOCEntry) {
+	var (
+		headings = findHeadings(body)
+		used     = map[string]bool{}
+		explicit = map[string]bool{}
+		stack    []*TOCEntry
+		buf      bytes.Buffer
+		last     int
+	)
+	for _, h := range headings {
+		if h.id != "" {
+			explicit[h.id] = true
+		}
+	}
+	for _, h := range headings {
+		var (
+			text  = htmlText(h.inner)
+			base  = h.id
+			id    string
+			entry *TOCEntry
+		)
+		if base == "" {
+			base = headingID(text)
+		}
+		id = base
+		for n := 1; used[id] || (id != h.id && explicit[id]); n++ {
+			id = fmt.Sprintf("%v-%v", base, n)
+		}
+		used[id] = true
+		buf.WriteString(body[last:h.start])
+		if id != h.id {
+			attrs := idAttrPattern.ReplaceAllString(h.attrs, "")
+			fmt.Fprintf(&buf, `<h%v id="%v"%v>%v</h%v>`, h.level, html.EscapeString(id), attrs, h.inner, h.level)
+		} else {
+			buf.WriteString(body[h.start:h.end])
+		}
+		last = h.end
+		entry = &TOCEntry{Level: h.level, Text: text, ID: id}
+		for len(stack) > 0 && stack[len(stack)-1].Level >= h.level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			toc = append(toc, entry)
+		} else {
+			parent := stack[len(stack)-1]
+			parent.Children = append(parent.Children, entry)
+		}
+		stack = append(stack, entry)
+	}
+	buf.WriteString(body[last:])
+	return buf.String(), toc
+}
+
+// Returns the entries with levels from min to max.  The children of entries
+// above min take their place.
+func filterTOC(entries []*TOCEntry, min int, max int) (out []*TOCEntry) {
+	for _, e := range entries {
+		switch {
+		case e.Level > max:
+		case e.Level < min:
+			out = append(out, filterTOC(e.Children, min, max)...)
+		default:
+			out = append(out, &TOCEntry{
+				Level:    e.Level,
+				Text:     e.Text,
+				ID:       e.ID,
+				Children: filterTOC(e.Children, min, max),
+			})
+		}
+	}
+	return
+}
+
+func writeTOC(buf *bytes.Buffer, entries []*TOCEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	buf.WriteString("<ul>")
+	for _, e := range entries {
+		fmt.Fprintf(buf, `<li><a href="#%v">%v</a>`, html.EscapeString(e.ID), html.EscapeString(e.Text))
+		writeTOC(buf, e.Children)
+		buf.WriteString("</li>")
+	}
+	buf.WriteString("</ul>")
+}
+
+// Renders a table of contents as nested lists of links, limited to headings
+// with levels from min to max.  Zero values mean 1 and 6.
+func renderTOC(toc []*TOCEntry, min int, max int) string {
+	var buf bytes.Buffer
+	if min == 0 {
+		min = 1
+	}
+	if max == 0 {
+		max = 6
+	}
+	writeTOC(&buf, filterTOC(toc, min, max))
+	return buf.String()
+}
+
+// Parses a "min max" level range given to a template function.
+func tocLevels(levels []int) (min int, max int, err error) {
+	switch len(levels) {
+	case 0:
+	case 1:
+		min = levels[0]
+	case 2:
+		min, max = levels[0], levels[1]
+	default:
+		err = fmt.Errorf("toc takes at most a minimum and maximum level")
+	}
+	return
+}
+
+// Returns a marker for the table of contents, which is rendered in its place
+// once the post body, and so its headings, are known.
+func tocMarker(levels ...int) (s string, err error) {
+	var min, max int
+	if min, max, err = tocLevels(levels); err != nil {
+		return
+	}
+	return fmt.Sprintf(tocPlaceholderText, min, max), nil
+}
+
+// Replaces table of contents markers in a rendered post body.
+func replaceTOCMarkers(body string, toc []*TOCEntry) string {
+	return tocPlaceholder.ReplaceAllStringFunc(body, func(marker string) string {
+		m := tocPlaceholder.FindStringSubmatch(marker)
+		min, _ := strconv.Atoi(m[1])
+		max, _ := strconv.Atoi(m[2])
+		return renderTOC(toc, min, max)
+	})
+}
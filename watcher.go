@@ -19,6 +19,7 @@ import (
 	"github.com/howeyc/fsnotify"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -28,6 +29,8 @@ type Watcher struct {
 	root    string
 	gw      *GhostWriter
 	watched map[string]bool
+	mu      sync.Mutex
+	changed []string
 }
 
 func NewWatcher(gw *GhostWriter, root string) (w *Watcher, err error) {
@@ -56,6 +59,9 @@ func (w *Watcher) Handle(work chan bool, e chan error) {
 		select {
 		case evt = <-w.watcher.Event:
 			w.gw.log.Printf("Filesystem changed: %v\n", evt.String())
+			w.mu.Lock()
+			w.changed = append(w.changed, evt.Name)
+			w.mu.Unlock()
 			isNewDir := evt.IsCreate() && w.gw.isDir(evt.Name)
 			if isNewDir || evt.IsDelete() || evt.IsRename() {
 				err = w.WatchDirs()
@@ -79,6 +85,15 @@ func (w *Watcher) Handle(work chan bool, e chan error) {
 	}
 }
 
+// Returns the paths changed since the last call, clearing the list.
+func (w *Watcher) Changes() (paths []string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	paths = w.changed
+	w.changed = nil
+	return
+}
+
 func (w *Watcher) WatchPath(path string) (err error) {
 	if _, ok := w.watched[path]; !ok {
 		w.gw.log.Printf("Watching %v\n", path)
@@ -148,15 +163,19 @@ func (w *Watcher) WatchDirs() (err error) {
 }
 
 // Watches the filesystem for changes and runs gw.Process in response.
+// Build failures are logged and recorded in gw.Status, only errors from the
+// filesystem watcher itself stop watching.
 func Watch(gw *GhostWriter, root string) (err error) {
 	var (
 		working bool = true
 		timer   *time.Timer
+		publish *time.Timer
 		watcher *Watcher
 	)
 	var (
-		errors = make(chan error, 1)
-		work   = make(chan bool, 1)
+		errors    = make(chan error, 1)
+		work      = make(chan bool, 1)
+		scheduled = make(chan time.Time, 1)
 	)
 
 	if watcher, err = NewWatcher(gw, root); err != nil {
@@ -180,11 +199,37 @@ func Watch(gw *GhostWriter, root string) (err error) {
 				timer = nil
 			}
 			timer = time.AfterFunc(200*time.Millisecond, func() {
+				changes := watcher.Changes()
 				gw.log.Printf("Processing site:\n")
 				if err := gw.Process(); err != nil {
-					errors <- err
+					// Keep watching, the next change may fix the build.
+					gw.log.Printf("Build failed: %v\n", err)
+					if gw.reloader != nil {
+						// Show the error overlay in open pages.
+						gw.reloader.Broadcast("reload")
+					}
+					return
 				}
+				if gw.reloader != nil {
+					gw.reloader.Broadcast(reloadEventFor(changes))
+				}
+				scheduled <- gw.NextScheduled()
 			})
+		case next := <-scheduled:
+			// Rebuild once the next scheduled post should be published.
+			if publish != nil {
+				publish.Stop()
+				publish = nil
+			}
+			if !next.IsZero() {
+				gw.log.Printf("Next scheduled post at %v\n", next)
+				publish = time.AfterFunc(time.Until(next), func() {
+					select {
+					case work <- true:
+					default:
+					}
+				})
+			}
 		case err = <-errors:
 			working = false
 		}